@@ -0,0 +1,27 @@
+// Package cors implements the origin matching shared by the CORS support of
+// the HTTP and gRPC-Web handlers.
+package cors
+
+import "strings"
+
+// AllowsOrigin returns true if origin matches one of the allowed origins,
+// or if allowed is empty. An allowed origin can contain a "*" wildcard, as
+// in "https://*.example.com", and "*" matches any origin. Origins are
+// compared case-insensitively.
+func AllowsOrigin(allowed []string, origin string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if prefix, suffix, ok := strings.Cut(a, "*"); ok {
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		} else if origin == a {
+			return true
+		}
+	}
+	return false
+}
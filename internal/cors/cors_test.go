@@ -0,0 +1,30 @@
+package cors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowsOrigin(t *testing.T) {
+	tests := map[string]struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		"any":               {nil, "https://example.com", true},
+		"star":              {[]string{"*"}, "https://example.com", true},
+		"exact":             {[]string{"https://example.com"}, "https://example.com", true},
+		"case-insensitive":  {[]string{"https://Example.com"}, "HTTPS://example.COM", true},
+		"other":             {[]string{"https://example.com"}, "https://example.org", false},
+		"wildcard":          {[]string{"https://*.example.com"}, "https://app.example.com", true},
+		"wildcard suffix":   {[]string{"https://*.example.com"}, "https://example.com", false},
+		"wildcard port":     {[]string{"http://localhost:*"}, "http://localhost:8080", true},
+		"overlapping affix": {[]string{"https://a*a"}, "https://a", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, AllowsOrigin(tc.allowed, tc.origin))
+		})
+	}
+}
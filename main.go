@@ -1,16 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"foxygo.at/jig/bones"
 	"foxygo.at/jig/log"
 	"foxygo.at/jig/serve"
 	"foxygo.at/jig/serve/httprule"
+	"foxygo.at/jig/serve/twirp"
 	"github.com/alecthomas/kong"
 	"github.com/alecthomas/protobuf/compiler"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
@@ -22,6 +31,8 @@ type config struct {
 	LogLevel log.LogLevel     `short:"L" help:"Log level" default:"error"`
 	Serve    cmdServe         `cmd:"" help:"Serve GRPC services"`
 	Bones    cmdBones         `cmd:"" help:"Generate skeleton jsonnet methods"`
+	Gateway  cmdGateway       `cmd:"" help:"Serve HTTP, transcoding requests to an upstream gRPC server"`
+	OpenAPI  cmdOpenAPI       `cmd:"" name:"openapi" help:"Generate an OpenAPI document of the HTTP methods of services"`
 }
 
 type cmdServe struct {
@@ -32,10 +43,70 @@ type cmdServe struct {
 
 	Listen string `short:"l" default:"localhost:8080" help:"TCP listen address"`
 	HTTP   bool   `short:"h" help:"Serve on HTTP too, using HttpRule annotations"`
+	Admin  bool   `help:"Serve the admin API for runtime method overrides on HTTP"`
+
+	GRPCWeb bool `name:"grpc-web" help:"Serve gRPC-Web for browser clients too, allowing cross-origin calls with the --cors flags"`
+	Connect bool `help:"Serve the Connect protocol too"`
+	Twirp   bool `help:"Serve the Twirp protocol too, under /twirp"`
+
+	httpFlags `embed:""`
 
 	Dirs []string `arg:"" help:"Directory containing method definitions and optionally protoset .pb file"`
 }
 
+type cmdGateway struct {
+	ProtoSet []string `short:"p" help:"Protoset .pb files containing service and deps"`
+
+	Proto     []string `short:"P" help:"Proto source .proto files containing service"`
+	ProtoPath []string `short:"I" help:"Import paths for --proto files' dependencies"`
+
+	Listen      string `short:"l" default:"localhost:8080" help:"TCP listen address"`
+	Upstream    string `short:"u" required:"" help:"Address of the gRPC server to forward requests to"`
+	UpstreamTLS bool   `name:"upstream-tls" help:"Connect to the upstream gRPC server with TLS"`
+
+	httpFlags `embed:""`
+
+	Dirs []string `arg:"" optional:"" help:"Directory containing protoset .pb files"`
+}
+
+type cmdOpenAPI struct {
+	ProtoSet []string `short:"p" help:"Protoset .pb files containing service and deps"`
+
+	Proto     []string `short:"P" help:"Proto source .proto files containing service"`
+	ProtoPath []string `short:"I" help:"Import paths for --proto files' dependencies"`
+
+	httpRuleFlags `embed:""`
+
+	Output string   `short:"o" help:"File to write the OpenAPI document to instead of stdout"`
+	Dirs   []string `arg:"" optional:"" help:"Directory containing protoset .pb files"`
+}
+
+// httpFlags configure how methods are served over HTTP.
+type httpFlags struct {
+	OpenAPI bool `name:"openapi" help:"Serve an OpenAPI document of the HTTP methods at /openapi.json"`
+
+	httpRuleFlags `embed:""`
+
+	IncomingHeader       []string `name:"incoming-header" placeholder:"NAME" help:"HTTP request headers to forward to methods as incoming metadata, such as Authorization"`
+	IncomingHeaderPrefix []string `name:"incoming-header-prefix" placeholder:"PREFIX[=MDPREFIX]" help:"Forward HTTP request headers starting with PREFIX as incoming metadata, replacing PREFIX with MDPREFIX if given"`
+
+	CORS             bool          `help:"Allow cross-origin HTTP requests from browsers (implied by the other --cors flags)" group:"CORS"`
+	CORSOrigin       []string      `name:"cors-origin" help:"Origins allowed to make cross-origin requests, may contain a * wildcard (default: any)" group:"CORS"`
+	CORSHeader       []string      `name:"cors-header" help:"Request headers allowed in cross-origin requests (default: any)" group:"CORS"`
+	CORSMethod       []string      `name:"cors-method" help:"HTTP methods allowed in cross-origin requests (default: those of the matching routes)" group:"CORS"`
+	CORSExposeHeader []string      `name:"cors-expose-header" help:"Response headers exposed to cross-origin front ends" group:"CORS"`
+	CORSCredentials  bool          `name:"cors-credentials" help:"Allow cross-origin requests with credentials" group:"CORS"`
+	CORSMaxAge       time.Duration `name:"cors-max-age" help:"How long browsers may cache preflight responses" group:"CORS"`
+}
+
+// httpRuleFlags configure the HTTP rules of methods.
+type httpRuleFlags struct {
+	ServiceConfig []string `placeholder:"FILE" help:"gRPC API service config YAML files with HTTP rules for the methods"`
+	HTTPRule      []string `name:"http-rule" sep:"none" placeholder:"RULE" help:"HttpRule templates for methods without HTTP rules, as 'METHOD PATH [BODY]' with {package}, {service} and {method} replaced"`
+	HTTPAuto      bool     `name:"http-auto" help:"Derive HTTP rules for methods without them from AIP naming conventions"`
+	HTTPJSONArray bool     `name:"http-json-array" help:"Stream the responses of server-streaming methods as a JSON array to clients getting JSON without asking for application/json"`
+}
+
 type cmdBones struct {
 	ProtoSet string `short:"p" help:"Protoset .pb file containing service and deps" xor:"proto"`
 
@@ -78,19 +149,60 @@ func (cs *cmdServe) Run(logLevel log.LogLevel) error {
 		return err
 	}
 
-	if cs.HTTP {
-		h, err := httprule.NewHandler(s.Files, s.UnknownHandler, httprule.WithLogger(logger))
-		if err != nil {
-			return err
-		}
+	h, err := cs.newHTTPHandler(s, logger)
+	if err != nil {
+		return err
+	}
+	if h != nil {
 		s.SetHTTPHandler(h)
 	}
 
 	return s.ListenAndServe(cs.Listen)
 }
 
+// newHTTPHandler returns the handler of the non-gRPC traffic of s: Twirp
+// requests with --twirp, falling back to the HttpRule handler with --http.
+// It returns nil if neither is enabled.
+func (cs *cmdServe) newHTTPHandler(s *serve.Server, logger log.Logger) (http.Handler, error) {
+	var h http.Handler
+	if cs.HTTP {
+		httpOpts, err := cs.getHTTPRuleOptions(logger)
+		if err != nil {
+			return nil, err
+		}
+		if h, err = httprule.NewHandler(s.Files, s.UnknownHandler, httpOpts...); err != nil {
+			return nil, err
+		}
+	}
+	if cs.Twirp {
+		twirpOpts := []twirp.Option{twirp.WithLogger(logger)}
+		if h != nil {
+			twirpOpts = append(twirpOpts, twirp.WithDefaultHandler(h))
+		}
+		th, err := twirp.NewHandler(s.Files, s.UnknownHandler, twirpOpts...)
+		if err != nil {
+			return nil, err
+		}
+		h = th
+	}
+	return h, nil
+}
+
 func (cs *cmdServe) getServerOptions(logger log.Logger) ([]serve.Option, error) {
 	opts := []serve.Option{serve.WithLogger(logger), serve.WithProtosets(cs.ProtoSet...)}
+	if cs.Admin {
+		opts = append(opts, serve.WithAdminAPI())
+	}
+	if cs.GRPCWeb {
+		if _, ok := cs.cors(); ok {
+			opts = append(opts, serve.WithGRPCWebCORS(cs.CORSOrigin...))
+		} else {
+			opts = append(opts, serve.WithGRPCWeb())
+		}
+	}
+	if cs.Connect {
+		opts = append(opts, serve.WithConnect())
+	}
 	if len(cs.Proto) != 0 {
 		includeImports := true
 		fds, err := compiler.Compile(cs.Proto, cs.ProtoPath, includeImports)
@@ -102,6 +214,143 @@ func (cs *cmdServe) getServerOptions(logger log.Logger) ([]serve.Option, error)
 	return opts, nil
 }
 
+func (hf *httpFlags) getHTTPRuleOptions(logger log.Logger) ([]httprule.Option, error) {
+	opts, err := hf.httpRuleFlags.getHTTPRuleOptions(logger)
+	if err != nil {
+		return nil, err
+	}
+	if hf.OpenAPI {
+		opts = append(opts, httprule.WithOpenAPI(httprule.DefaultOpenAPIPath))
+	}
+	if len(hf.IncomingHeader) != 0 {
+		opts = append(opts, httprule.WithIncomingHeaders(hf.IncomingHeader...))
+	}
+	for _, prefix := range hf.IncomingHeaderPrefix {
+		httpPrefix, mdPrefix, ok := strings.Cut(prefix, "=")
+		if !ok {
+			mdPrefix = httpPrefix
+		}
+		opts = append(opts, httprule.WithIncomingHeaderPrefix(httpPrefix, mdPrefix))
+	}
+	if cors, ok := hf.cors(); ok {
+		opts = append(opts, httprule.WithCORS(cors))
+	}
+	return opts, nil
+}
+
+// cors returns the CORS configuration of the flags, and whether
+// cross-origin requests are allowed at all.
+func (hf *httpFlags) cors() (httprule.CORS, bool) {
+	cors := httprule.CORS{
+		AllowedOrigins:   hf.CORSOrigin,
+		AllowedHeaders:   hf.CORSHeader,
+		AllowedMethods:   hf.CORSMethod,
+		ExposedHeaders:   hf.CORSExposeHeader,
+		AllowCredentials: hf.CORSCredentials,
+		MaxAge:           hf.CORSMaxAge,
+	}
+	return cors, hf.CORS || !reflect.ValueOf(cors).IsZero()
+}
+
+func (hr *httpRuleFlags) getHTTPRuleOptions(logger log.Logger) ([]httprule.Option, error) {
+	opts := []httprule.Option{httprule.WithLogger(logger)}
+	for _, path := range hr.ServiceConfig {
+		opts = append(opts, httprule.WithServiceConfig(path))
+	}
+	if len(hr.HTTPRule) != 0 {
+		templates := make([]*annotations.HttpRule, len(hr.HTTPRule))
+		for i, s := range hr.HTTPRule {
+			rule, err := httprule.ParseRule(s)
+			if err != nil {
+				return nil, err
+			}
+			templates[i] = rule
+		}
+		opts = append(opts, httprule.WithRuleTemplates(templates))
+	}
+	if hr.HTTPAuto {
+		opts = append(opts, httprule.WithAutoRules())
+	}
+	if hr.HTTPJSONArray {
+		opts = append(opts, httprule.WithJSONStreamArrays())
+	}
+	return opts, nil
+}
+
+func (cg *cmdGateway) Run(logLevel log.LogLevel) error {
+	logger := log.NewLogger(os.Stderr, logLevel)
+	h, conn, err := cg.newGateway(logger)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint: errcheck
+	logger.Infof("forwarding HTTP requests on %s to %s", cg.Listen, cg.Upstream)
+	return http.ListenAndServe(cg.Listen, h) //nolint: gosec
+}
+
+// newGateway returns an HTTP handler forwarding transcoded requests to the
+// upstream gRPC server over the returned connection.
+func (cg *cmdGateway) newGateway(logger log.Logger) (*httprule.Handler, *grpc.ClientConn, error) {
+	cs := cmdServe{ProtoSet: cg.ProtoSet, Proto: cg.Proto, ProtoPath: cg.ProtoPath}
+	opts, err := cs.getServerOptions(logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := serve.NewServer(serve.JsonnetEvaluator(), serve.NewFSFromDirs(cg.Dirs...), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpOpts, err := cg.getHTTPRuleOptions(logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	creds := insecure.NewCredentials()
+	if cg.UpstreamTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.NewClient(cg.Upstream, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := httprule.NewGateway(s.Files, conn, httpOpts...)
+	if err != nil {
+		conn.Close() //nolint: errcheck
+		return nil, nil, err
+	}
+	return h, conn, nil
+}
+
+func (co *cmdOpenAPI) Run(logLevel log.LogLevel) error {
+	logger := log.NewLogger(os.Stderr, logLevel)
+	cs := cmdServe{ProtoSet: co.ProtoSet, Proto: co.Proto, ProtoPath: co.ProtoPath}
+	opts, err := cs.getServerOptions(logger)
+	if err != nil {
+		return err
+	}
+	s, err := serve.NewServer(serve.JsonnetEvaluator(), serve.NewFSFromDirs(co.Dirs...), opts...)
+	if err != nil {
+		return err
+	}
+	httpOpts, err := co.getHTTPRuleOptions(logger)
+	if err != nil {
+		return err
+	}
+	h, err := httprule.NewHandler(s.Files, s.UnknownHandler, httpOpts...)
+	if err != nil {
+		return err
+	}
+	b, err := h.OpenAPI()
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if co.Output == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(co.Output, b, 0o666)
+}
+
 func (cb *cmdBones) Run(logLevel log.LogLevel) error {
 	logger := log.NewLogger(os.Stderr, logLevel)
 	fds := &descriptorpb.FileDescriptorSet{}
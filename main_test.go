@@ -1,89 +1,357 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"foxygo.at/jig/log"
 	"foxygo.at/jig/pb/exemplar"
+	"foxygo.at/jig/pb/httpgreet"
 	"foxygo.at/jig/serve"
-	"foxygo.at/jig/serve/httprule"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/testing/protocmp"
 )
 
+// testServer is a started serve.TestServer with clients connected to it.
+type testServer struct {
+	*serve.TestServer
+	httpClient *http.Client
+	baseURL    string // of HTTP requests
+	cc         *grpc.ClientConn
+}
+
+// testServers start a TestServer with the given options, listening on a
+// TCP port or in memory. It is stopped when the test finishes.
+var testServers = map[string]func(t *testing.T, vfs fs.FS, opts ...serve.Option) testServer{
+	"TCP": func(t *testing.T, vfs fs.FS, opts ...serve.Option) testServer {
+		t.Helper()
+		ts := serve.NewTestServer(serve.JsonnetEvaluator(), vfs, opts...)
+		t.Cleanup(ts.Stop)
+		cc, err := grpc.NewClient(ts.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() }) //nolint:errcheck
+		return testServer{TestServer: ts, httpClient: http.DefaultClient, baseURL: "http://" + ts.Addr(), cc: cc}
+	},
+	"InMemory": func(t *testing.T, vfs fs.FS, opts ...serve.Option) testServer {
+		t.Helper()
+		ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), vfs, opts...)
+		return testServer{TestServer: ts, httpClient: ts.HTTPClient, baseURL: "http://jig", cc: ts.ClientConn}
+	},
+}
+
+// withHTTPHandler is a serve.Option serving HTTP with the handler jig serve
+// creates from the flags of c.
+func withHTTPHandler(c *cmdServe) serve.Option {
+	return serve.WithHTTPHandler(func(s *serve.Server) (http.Handler, error) {
+		return c.newHTTPHandler(s, log.DiscardLogger)
+	})
+}
+
 func TestHTTPRuleServer(t *testing.T) {
 	c := cmdServe{
 		Proto:     []string{"httpgreet/httpgreet.proto"},
 		ProtoPath: []string{"proto"},
+		HTTP:      true,
+	}
+	opts, err := c.getServerOptions(log.DiscardLogger)
+	require.NoError(t, err)
+	opts = append(opts, withHTTPHandler(&c))
+
+	for name, newTestServer := range testServers {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, os.DirFS("serve/testdata/httpgreet"), opts...)
+			baseURL := ts.baseURL
+			resp, err := ts.httpClient.Get(baseURL + "/api/greet/hello/Dolly")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"greeting":"httpgreet: Hello, Dolly"}`, string(b))
+
+			resp, err = ts.httpClient.Post(baseURL+"/api/greet/hello", "application/json", strings.NewReader(`{"firstName": "Kitty"}`))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"greeting":"Thanks for the post, Kitty"}`, string(b))
+
+			resp, err = ts.httpClient.Post(baseURL+"/api/greet/world", "application/json", strings.NewReader(`{}`))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"greeting":"Thanks for the post and the path, world"}`, string(b))
+		})
+	}
+}
+
+func TestHTTPRuleCORS(t *testing.T) {
+	c := cmdServe{
+		HTTP:      true,
+		Proto:     []string{"httpgreet/httpgreet.proto"},
+		ProtoPath: []string{"proto"},
+		httpFlags: httpFlags{
+			CORSOrigin: []string{"https://*.example.com"},
+			CORSMaxAge: time.Minute,
+		},
 	}
 	opts, err := c.getServerOptions(log.DiscardLogger)
 	require.NoError(t, err)
+	opts = append(opts, withHTTPHandler(&c))
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), opts...)
+
+	req, err := http.NewRequest(http.MethodOptions, "http://jig/api/greet/hello", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	resp, err := ts.HTTPClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "content-type", resp.Header.Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+}
 
-	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), opts...)
-	handler, err := httprule.NewHandler(ts.Files, ts.UnknownHandler, httprule.WithLogger(log.DiscardLogger))
+func TestGRPCWebCORS(t *testing.T) {
+	c := cmdServe{
+		Proto:     []string{"greet/greeter.proto"},
+		ProtoPath: []string{"proto"},
+		GRPCWeb:   true,
+		httpFlags: httpFlags{
+			CORSOrigin: []string{"https://*.example.com"},
+		},
+	}
+	opts, err := c.getServerOptions(log.DiscardLogger)
 	require.NoError(t, err)
-	ts.SetHTTPHandler(handler)
-	ts.Start()
-	defer ts.Stop()
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("serve/testdata/greet"), opts...)
 
-	baseURL := "http://" + ts.Addr()
-	resp, err := http.Get(baseURL + "/api/greet/hello/Dolly")
+	// An empty HelloRequest in a single gRPC-Web message frame.
+	body := bytes.NewReader([]byte{0, 0, 0, 0, 0})
+	req, err := http.NewRequest(http.MethodPost, "http://jig/greet.Greeter/Hello", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc-web")
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err := ts.HTTPClient.Do(req)
 	require.NoError(t, err)
 	defer resp.Body.Close()
 	b, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	require.JSONEq(t, `{"greeting":"httpgreet: Hello, Dolly"}`, string(b))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/grpc-web", resp.Header.Get("Content-Type"))
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Contains(t, string(b), "Hello")
+	require.True(t, strings.HasSuffix(string(b), "grpc-status: 0\r\n"), string(b))
+}
+
+func TestConnect(t *testing.T) {
+	c := cmdServe{
+		Proto:     []string{"greet/greeter.proto"},
+		ProtoPath: []string{"proto"},
+		Connect:   true,
+	}
+	opts, err := c.getServerOptions(log.DiscardLogger)
+	require.NoError(t, err)
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("serve/testdata/greet"), opts...)
 
-	resp, err = http.Post(baseURL+"/api/greet/hello", "application/json", strings.NewReader(`{"firstName": "Kitty"}`))
+	resp, err := ts.HTTPClient.Post("http://jig/greet.Greeter/Hello", "application/json", strings.NewReader(`{"firstName": "Kitty"}`))
 	require.NoError(t, err)
 	defer resp.Body.Close()
-	b, err = io.ReadAll(resp.Body)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(b))
+	require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello Kitty"}`, string(b))
+}
+
+func TestTwirp(t *testing.T) {
+	c := cmdServe{
+		Proto:     []string{"httpgreet/httpgreet.proto"},
+		ProtoPath: []string{"proto"},
+		HTTP:      true,
+		Twirp:     true,
+	}
+	opts, err := c.getServerOptions(log.DiscardLogger)
 	require.NoError(t, err)
+	opts = append(opts, withHTTPHandler(&c))
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), opts...)
+
+	resp, err := ts.HTTPClient.Post("http://jig/twirp/httpgreet.HttpGreeter/PostHello", "application/json", strings.NewReader(`{"first_name": "Kitty"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(b))
 	require.JSONEq(t, `{"greeting":"Thanks for the post, Kitty"}`, string(b))
 
-	resp, err = http.Post(baseURL+"/api/greet/world", "application/json", strings.NewReader(`{}`))
+	// Requests outside /twirp fall back to the HttpRule handler.
+	resp, err = ts.HTTPClient.Get("http://jig/api/greet/hello/Dolly")
 	require.NoError(t, err)
 	defer resp.Body.Close()
 	b, err = io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	require.JSONEq(t, `{"greeting":"Thanks for the post and the path, world"}`, string(b))
+	require.JSONEq(t, `{"greeting":"httpgreet: Hello, Dolly"}`, string(b))
 }
 
-func TestExemplar(t *testing.T) {
+func TestHTTPRuleServiceConfig(t *testing.T) {
 	c := cmdServe{
-		ProtoSet: []string{"pb/exemplar/exemplar.pb"},
+		HTTP:      true,
+		Proto:     []string{"httpgreet/httpgreet.proto"},
+		ProtoPath: []string{"proto"},
+		httpFlags: httpFlags{httpRuleFlags: httpRuleFlags{
+			ServiceConfig: []string{"serve/testdata/httpgreet/service.yaml"},
+		}},
 	}
 	opts, err := c.getServerOptions(log.DiscardLogger)
 	require.NoError(t, err)
+	opts = append(opts, withHTTPHandler(&c))
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), opts...)
 
-	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("bones/testdata/golden/exemplar-single-no-minimal"), opts...)
-	handler, err := httprule.NewHandler(ts.Files, ts.UnknownHandler, httprule.WithLogger(log.DiscardLogger))
+	resp, err := ts.HTTPClient.Get("http://jig/v1/SimpleHello?first_name=fox")
 	require.NoError(t, err)
-	ts.SetHTTPHandler(handler)
-	ts.Start()
-	defer ts.Stop()
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+	require.JSONEq(t, `{"greeting": "Simply, hello, fox"}`, string(raw))
+}
 
-	dialOpts := []grpc.DialOption{
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+func TestHTTPRuleTemplatesAndAuto(t *testing.T) {
+	c := cmdServe{
+		HTTP:     true,
+		ProtoSet: []string{"pb/library/library.pb", "pb/httpgreet/httpgreet.pb"},
+		httpFlags: httpFlags{httpRuleFlags: httpRuleFlags{
+			HTTPRule: []string{"GET /{service}/{method}", "POST /{package}.{service}/{method}"},
+			HTTPAuto: true,
+		}},
 	}
-	cc, err := grpc.NewClient(ts.Addr(), dialOpts...)
+	opts, err := c.getServerOptions(log.DiscardLogger)
 	require.NoError(t, err)
-	defer cc.Connect()
-	client := exemplar.NewExemplarClient(cc)
+	opts = append(opts, withHTTPHandler(&c))
+	vfs := serve.NewFSFromDirs("serve/testdata/library", "serve/testdata/httpgreet")
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), vfs, opts...)
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := ts.HTTPClient.Get("http://jig" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+		return string(raw)
+	}
+	require.JSONEq(t, `{"name": "shelves/scifi/books/dune", "title": "Dune", "author": "Frank Herbert"}`, get("/v1/shelves/scifi/books/dune"))
+	require.JSONEq(t, `{"greeting": "Simply, hello, fox"}`, get("/HttpGreeter/SimpleHello?first_name=fox"))
+	require.JSONEq(t, `{"title": "Dune", "author": "Frank Herbert"}`, get("/Library/Recommend?author=Frank%20Herbert"))
+
+	c.HTTPRule = []string{"GET"}
+	_, err = c.getHTTPRuleOptions(log.DiscardLogger)
+	require.Error(t, err)
+}
 
-	req := &exemplar.SampleRequest{Name: "Grace"}
-	resp, err := client.Sample(context.Background(), req)
+func TestGateway(t *testing.T) {
+	upstream := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), serve.WithLogger(log.DiscardLogger))
+	upstream.Start()
+	defer upstream.Stop()
+
+	c := cmdGateway{
+		ProtoSet: []string{"pb/httpgreet/httpgreet.pb"},
+		Upstream: upstream.Addr(),
+		httpFlags: httpFlags{httpRuleFlags: httpRuleFlags{
+			HTTPRule: []string{"GET /{method}"},
+		}},
+	}
+	h, conn, err := c.newGateway(log.DiscardLogger)
 	require.NoError(t, err)
-	require.False(t, resp.GetABool())
-	require.Equal(t, map[int32]bool{0: false}, resp.GetAMap())
+	defer conn.Close()
+
+	for path, want := range map[string]string{
+		"/api/greet/hello/fox":        `{"greeting": "httpgreet: Hello, fox"}`,
+		"/SimpleHello?first_name=fox": `{"greeting": "Simply, hello, fox"}`,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, want, w.Body.String())
+	}
+}
+
+func TestGatewayIncomingHeaders(t *testing.T) {
+	hello := func(ctx context.Context, req *httpgreet.HelloRequest) (*httpgreet.HelloResponse, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		greeting := strings.Join(append(md.Get("authorization"), md.Get("acme-tenant")...), " ")
+		return &httpgreet.HelloResponse{Greeting: greeting}, nil
+	}
+	withHandler := serve.WithMethodHandler("httpgreet.HttpGreeter.GetHello", serve.UnaryHandler(hello))
+	upstream := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("serve/testdata/httpgreet"), serve.WithLogger(log.DiscardLogger), withHandler)
+	upstream.Start()
+	defer upstream.Stop()
+
+	c := cmdGateway{
+		ProtoSet: []string{"pb/httpgreet/httpgreet.pb"},
+		Upstream: upstream.Addr(),
+		httpFlags: httpFlags{
+			IncomingHeader:       []string{"authorization"},
+			IncomingHeaderPrefix: []string{"X-Acme-=acme-"},
+		},
+	}
+	h, conn, err := c.newGateway(log.DiscardLogger)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := httptest.NewRequest("GET", "/api/greet/hello/fox", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Acme-Tenant", "acme")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"greeting": "Bearer token acme"}`, w.Body.String())
+}
+
+func TestOpenAPICommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "openapi.json")
+	c := cmdOpenAPI{
+		Proto:     []string{"httpgreet/httpgreet.proto"},
+		ProtoPath: []string{"proto"},
+		Output:    out,
+	}
+	require.NoError(t, c.Run(log.LogLevelError))
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(b, &doc))
+	require.Equal(t, "3.0.3", doc.OpenAPI)
+	require.Contains(t, doc.Paths, "/api/greet/hello/{first_name}")
+	require.Contains(t, doc.Paths["/api/greet/hello"], "post")
+}
+
+func TestExemplar(t *testing.T) {
+	c := cmdServe{
+		ProtoSet: []string{"pb/exemplar/exemplar.pb"},
+		HTTP:     true,
+	}
+	opts, err := c.getServerOptions(log.DiscardLogger)
+	require.NoError(t, err)
+	opts = append(opts, withHTTPHandler(&c))
 
 	want := &exemplar.SampleResponse{
 		ABool:     false,
@@ -118,6 +386,18 @@ func TestExemplar(t *testing.T) {
 		AMessageList: []*exemplar.SampleResponse_SampleMessage1{{}},
 		Recursive:    &exemplar.SampleResponse{},
 	}
-	diff := cmp.Diff(want, resp, protocmp.Transform())
-	require.Empty(t, diff)
+
+	for name, newTestServer := range testServers {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, os.DirFS("bones/testdata/golden/exemplar-single-no-minimal"), opts...)
+			client := exemplar.NewExemplarClient(ts.cc)
+			req := &exemplar.SampleRequest{Name: "Grace"}
+			resp, err := client.Sample(context.Background(), req)
+			require.NoError(t, err)
+			require.False(t, resp.GetABool())
+			require.Equal(t, map[int32]bool{0: false}, resp.GetAMap())
+			diff := cmp.Diff(want, resp, protocmp.Transform())
+			require.Empty(t, diff)
+		})
+	}
 }
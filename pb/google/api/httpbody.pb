@@ -0,0 +1,17 @@
+
+
+google/protobuf/any.protogoogle.protobuf"6
+Any
+type_url (	RtypeUrl
+value (RvalueBv
+com.google.protobufBAnyProtoPZ,google.golang.org/protobuf/types/known/anypbGPBGoogle.Protobuf.WellKnownTypesbproto3
+
+google/api/httpbody.proto
+google.apigoogle/protobuf/any.proto"w
+HttpBody!
+content_type (	RcontentType
+data (Rdata4
+
+extensions (2.google.protobuf.AnyR
+extensionsBh
+com.google.apiBHttpBodyProtoPZ;google.golang.org/genproto/googleapis/api/httpbody;httpbodyGAPIbproto3
\ No newline at end of file
@@ -0,0 +1,120 @@
+package serve
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// AdminPathPrefix is the HTTP path prefix of the admin API, served by
+// Server.ServeHTTP when the server is created with WithAdminAPI. The admin
+// API is only served over HTTP; there is no gRPC admin service.
+//
+// The admin API manages runtime method overrides. Requests are scoped to the
+// session given by the X-Jig-Session header, or to all calls without it:
+//
+//	GET    /_jig/overrides           list overridden method names
+//	DELETE /_jig/overrides           remove all overrides (?all=true for all sessions)
+//	GET    /_jig/overrides/{method}  get the source of an overridden method
+//	PUT    /_jig/overrides/{method}  override a method with the request body
+//	DELETE /_jig/overrides/{method}  remove the override of a method
+//
+// It also serves the Journal of calls. The X-Jig-Session header filters the
+// calls by session; without it, calls of all sessions are included:
+//
+//	GET    /_jig/calls  list recorded calls (?method=pkg.Service.* to filter)
+//	DELETE /_jig/calls  clear recorded calls (?method=pkg.Service.* to filter)
+const AdminPathPrefix = "/_jig/"
+
+func (s *Server) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_jig/overrides", s.listOverrides)
+	mux.HandleFunc("DELETE /_jig/overrides", s.resetOverrides)
+	mux.HandleFunc("GET /_jig/overrides/{method}", s.getOverride)
+	mux.HandleFunc("PUT /_jig/overrides/{method}", s.putOverride)
+	mux.HandleFunc("DELETE /_jig/overrides/{method}", s.deleteOverride)
+	mux.HandleFunc("GET /_jig/calls", s.listCalls)
+	mux.HandleFunc("DELETE /_jig/calls", s.clearCalls)
+	return mux
+}
+
+func (s *Server) listOverrides(w http.ResponseWriter, r *http.Request) {
+	methods := s.Overrides.List(r.Header.Get(SessionHeader))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(methods); err != nil {
+		s.log.Errorf("failed to write overrides list: %v", err)
+	}
+}
+
+func (s *Server) resetOverrides(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("all") == "true" {
+		s.log.Debugf("admin: reset all overrides")
+		s.Overrides.ResetAll()
+	} else {
+		session := r.Header.Get(SessionHeader)
+		s.log.Debugf("admin: reset overrides of session %q", session)
+		s.Overrides.Reset(session)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getOverride(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.Overrides.Get(r.Header.Get(SessionHeader), r.PathValue("method"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := io.WriteString(w, source); err != nil {
+		s.log.Errorf("failed to write override: %v", err)
+	}
+}
+
+func (s *Server) putOverride(w http.ResponseWriter, r *http.Request) {
+	method := r.PathValue("method")
+	if s.lookupMethod(protoreflect.FullName(method)) == nil {
+		http.Error(w, "method not found: "+method, http.StatusNotFound)
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session := r.Header.Get(SessionHeader)
+	s.log.Debugf("admin: override %s for session %q", method, session)
+	s.Overrides.Set(session, method, string(b))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteOverride(w http.ResponseWriter, r *http.Request) {
+	method := r.PathValue("method")
+	session := r.Header.Get(SessionHeader)
+	if !s.Overrides.Delete(session, method) {
+		http.NotFound(w, r)
+		return
+	}
+	s.log.Debugf("admin: delete override %s for session %q", method, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listCalls(w http.ResponseWriter, r *http.Request) {
+	calls := s.Journal.Calls(callFilter(r))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(calls); err != nil {
+		s.log.Errorf("failed to write calls: %v", err)
+	}
+}
+
+func (s *Server) clearCalls(w http.ResponseWriter, r *http.Request) {
+	s.Journal.Clear(callFilter(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func callFilter(r *http.Request) CallFilter {
+	return CallFilter{
+		Method:  r.URL.Query().Get("method"),
+		Session: r.Header.Get(SessionHeader),
+	}
+}
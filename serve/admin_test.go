@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAdminOverrides(t *testing.T) {
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithAdminAPI())
+	defer ts.Stop()
+	c := newGreeterClient(t, ts.Addr())
+	defer c.Close()
+
+	baseURL := "http://" + ts.Addr() + "/_jig/overrides"
+	adminDo := func(method, path, session, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, baseURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if session != "" {
+			req.Header.Set(SessionHeader, session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+	hello := func(session string) string {
+		t.Helper()
+		ctx := context.Background()
+		if session != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, SessionHeader, session)
+		}
+		resp, err := c.Hello(ctx, &greet.HelloRequest{FirstName: "🌏"})
+		require.NoError(t, err)
+		return resp.Greeting
+	}
+	source := func(greeting string) string {
+		return `function(input) { response: { greeting: '` + greeting + `' } }`
+	}
+
+	code, _ := adminDo("PUT", "/greet.Greeter.Hello", "", source("global"))
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = adminDo("PUT", "/greet.Greeter.Hello", "s1", source("session"))
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = adminDo("PUT", "/greet.Greeter.Nope", "", source("nope"))
+	require.Equal(t, http.StatusNotFound, code)
+
+	require.Equal(t, "global", hello(""))
+	require.Equal(t, "session", hello("s1"))
+	require.Equal(t, "global", hello("s2"))
+
+	code, body := adminDo("GET", "", "s1", "")
+	require.Equal(t, http.StatusOK, code)
+	var methods []string
+	require.NoError(t, json.Unmarshal([]byte(body), &methods))
+	require.Equal(t, []string{"greet.Greeter.Hello"}, methods)
+	code, body = adminDo("GET", "/greet.Greeter.Hello", "s1", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, source("session"), body)
+
+	code, _ = adminDo("DELETE", "/greet.Greeter.Hello", "", "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = adminDo("DELETE", "/greet.Greeter.Hello", "", "")
+	require.Equal(t, http.StatusNotFound, code)
+	require.Equal(t, "💃 jig [unary]: Hello 🌏", hello(""))
+	require.Equal(t, "session", hello("s1"))
+
+	code, _ = adminDo("DELETE", "?all=true", "", "")
+	require.Equal(t, http.StatusNoContent, code)
+	require.Equal(t, "💃 jig [unary]: Hello 🌏", hello("s1"))
+	require.Empty(t, ts.Overrides.List("s1"))
+}
@@ -0,0 +1,130 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"foxygo.at/protog/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// JSONCodecName is the name of the gRPC codec encoding messages as JSON, and
+// the content-subtype of gRPC calls using it (application/grpc+json).
+const JSONCodecName = "json"
+
+// JSONCodec returns the gRPC codec encoding messages as JSON. A Server
+// accepts calls using it without it being registered; Go clients send them
+// with the grpc.ForceCodec call option.
+func JSONCodec() encoding.Codec {
+	return jsonCodec{}
+}
+
+// jsonCodec is a gRPC codec encoding protobuf messages as JSON, according
+// to the protojson encoding rules.
+//
+// The types of google.protobuf.Any fields are resolved with the registry of
+// a jsonMessage, or with the global registry of generated types for other
+// messages.
+type jsonCodec struct{}
+
+// jsonMessage is a message of a call using the JSON codec, with the
+// registry resolving the types of its google.protobuf.Any fields. It allows
+// dynamicpb messages to be encoded with the types of a Server's registry.
+type jsonMessage struct {
+	proto.Message
+	resolver *registry.Files
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *jsonMessage:
+		return protojson.MarshalOptions{Resolver: m.resolver}.Marshal(m.Message)
+	case proto.Message:
+		return protojson.Marshal(m)
+	}
+	return nil, fmt.Errorf("cannot marshal %T to JSON: not a proto.Message", v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *jsonMessage:
+		return protojson.UnmarshalOptions{Resolver: m.resolver}.Unmarshal(data, m.Message)
+	case proto.Message:
+		return protojson.Unmarshal(data, m)
+	}
+	return fmt.Errorf("cannot unmarshal JSON to %T: not a proto.Message", v)
+}
+
+func (jsonCodec) Name() string {
+	return JSONCodecName
+}
+
+// serverCodec is the gRPC codec of a Server, installed on its grpc.Server
+// only rather than registered for the whole process. It encodes the
+// jsonMessages of calls using the JSON codec as JSON, and all other
+// messages as binary protobuf.
+type serverCodec struct{}
+
+func (serverCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *jsonMessage:
+		return jsonCodec{}.Marshal(m)
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("cannot marshal %T: not a proto.Message", v)
+}
+
+func (serverCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *jsonMessage:
+		return jsonCodec{}.Unmarshal(data, m)
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("cannot unmarshal %T: not a proto.Message", v)
+}
+
+func (serverCodec) Name() string {
+	return "proto"
+}
+
+// jsonStream is a grpc.ServerStream of a gRPC call using the JSON codec. It
+// wraps the messages received and sent as jsonMessages so the codec
+// resolves their types with the server's registry.
+type jsonStream struct {
+	grpc.ServerStream
+	reg *registry.Files
+}
+
+func (s *jsonStream) RecvMsg(m interface{}) error {
+	return s.ServerStream.RecvMsg(&jsonMessage{Message: m.(proto.Message), resolver: s.reg})
+}
+
+func (s *jsonStream) SendMsg(m interface{}) error {
+	return s.ServerStream.SendMsg(&jsonMessage{Message: m.(proto.Message), resolver: s.reg})
+}
+
+// isJSONCall returns true if ctx is the context of a gRPC call using the
+// JSON codec, from its application/grpc+json content type. Calls transcoded
+// from other protocols, without a gRPC transport stream, never are.
+func isJSONCall(ctx context.Context) bool {
+	if grpc.ServerTransportStreamFromContext(ctx) == nil {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, contentType := range md.Get("content-type") {
+		subtype, ok := strings.CutPrefix(strings.ToLower(contentType), "application/grpc+")
+		if !ok {
+			continue
+		}
+		subtype, _, _ = strings.Cut(subtype, ";")
+		return strings.TrimSpace(subtype) == JSONCodecName
+	}
+	return false
+}
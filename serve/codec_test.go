@@ -0,0 +1,70 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"foxygo.at/jig/pb/greet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGreeterJSONCodec(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Stop()
+	c := newGreeterClient(t, ts.Addr())
+	defer c.Close()
+	ctx := context.Background()
+	jsonCodec := grpc.ForceCodec(JSONCodec())
+
+	var header metadata.MD
+	req := &greet.HelloRequest{FirstName: "🌏"}
+	resp, err := c.Hello(ctx, req, jsonCodec, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, "💃 jig [unary]: Hello 🌏", resp.Greeting)
+	require.Equal(t, []string{"application/grpc+json"}, header.Get("content-type"))
+
+	_, err = c.Hello(ctx, &greet.HelloRequest{FirstName: "Bart"}, jsonCodec)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := c.HelloServerStream(ctx, req, jsonCodec)
+	require.NoError(t, err)
+	var greetings []string
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		greetings = append(greetings, resp.Greeting)
+	}
+	require.Equal(t, []string{"💃 jig [server]: Hello 🌏", "💃 jig [server]: Goodbye 🌏"}, greetings)
+
+	calls := ts.Journal.Calls(CallFilter{Method: "greet.Greeter.Hello"})
+	require.NotEmpty(t, calls)
+	require.JSONEq(t, `{"firstName": "🌏"}`, string(calls[0].Requests[0]))
+}
+
+func TestJSONCodec(t *testing.T) {
+	codec := jsonCodec{}
+	b, err := codec.Marshal(&greet.HelloRequest{FirstName: "Kitty"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"firstName": "Kitty"}`, string(b))
+
+	req := &greet.HelloRequest{}
+	require.NoError(t, codec.Unmarshal([]byte(`{"first_name": "Kitty"}`), &jsonMessage{Message: req}))
+	require.Equal(t, "Kitty", req.FirstName)
+
+	_, err = codec.Marshal("not a message")
+	require.Error(t, err)
+	require.Error(t, codec.Unmarshal(b, new(string)))
+
+	// The codec is only installed on the grpc.Server of a Server.
+	require.Nil(t, encoding.GetCodec(JSONCodecName))
+}
@@ -0,0 +1,450 @@
+package serve
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"foxygo.at/protog/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// connectStreamingPrefix prefixes the content type of streaming
+	// Connect calls, e.g. application/connect+json.
+	connectStreamingPrefix = "application/connect+"
+
+	// Flags of the message envelopes of streaming Connect calls.
+	connectFlagCompressed = 0x01
+	connectFlagEndStream  = 0x02
+)
+
+// WithConnect is an Option to serve the Connect protocol on the server's
+// port, next to gRPC and HTTP. Connect calls are POST requests to
+// /pkg.service/method with a JSON or binary protobuf body, and are
+// dispatched to UnknownHandler like gRPC calls. Unary and streaming calls
+// are supported, but compressed messages are not.
+//
+// Unary calls without a Connect-Protocol-Version header cannot be told
+// apart from other JSON or protobuf POST requests, so they are only served
+// as Connect calls if the server has no HTTP handler.
+//
+// See https://connectrpc.com/docs/protocol.
+func WithConnect() Option {
+	return func(s *Server) error {
+		s.connect = true
+		return nil
+	}
+}
+
+// connectCode is the Connect name and HTTP status code of a gRPC status
+// code.
+type connectCode struct {
+	name       string
+	httpStatus int
+}
+
+var connectCodes = map[codes.Code]connectCode{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+// connectMethod returns the method called by r if it is a Connect call, or
+// nil otherwise. Connect calls are POST requests to /pkg.service/method with
+// a streaming Connect content type or a Connect-Protocol-Version header. If
+// anyUnary is true, POST requests with a JSON or binary protobuf body are
+// taken as unary Connect calls too, as clients may omit the header.
+func (s *Server) connectMethod(r *http.Request, anyUnary bool) protoreflect.MethodDescriptor {
+	if r.Method != http.MethodPost || strings.Count(r.URL.Path, "/") != 2 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isConnect := strings.HasPrefix(mediaType, connectStreamingPrefix) ||
+		r.Header.Get("Connect-Protocol-Version") != "" ||
+		anyUnary && (mediaType == "application/json" || mediaType == "application/proto")
+	if !isConnect {
+		return nil
+	}
+	// Convert /pkg.service/method -> pkg.service.method
+	name := strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/"), "/", ".")
+	return s.lookupMethod(protoreflect.FullName(name))
+}
+
+// serveConnect serves the Connect call r of the method md.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request, md protoreflect.MethodDescriptor) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	codec, streaming := strings.CutPrefix(mediaType, connectStreamingPrefix)
+	if !streaming {
+		codec = strings.TrimPrefix(mediaType, "application/")
+	}
+	isStreamingMethod := md.IsStreamingClient() || md.IsStreamingServer()
+	if (codec != "json" && codec != "proto") || streaming != isStreamingMethod {
+		w.Header().Set("Accept-Post", connectAcceptPost(isStreamingMethod))
+		http.Error(w, "unsupported content type "+mediaType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	cs := &connectStream{
+		ctx:       r.Context(),
+		w:         w,
+		body:      r.Body,
+		streaming: streaming,
+		json:      codec == "json",
+		reg:       s.Files,
+		header:    metadata.MD{},
+		trailer:   metadata.MD{},
+	}
+	cs.ctx = metadata.NewIncomingContext(cs.ctx, IncomingMetadata(r.Header, connectMetadataKey))
+	err := connectRequestError(r)
+	if err == nil && r.Header.Get("Connect-Timeout-Ms") != "" {
+		var cancel context.CancelFunc
+		cs.ctx, cancel, err = connectTimeout(cs.ctx, r.Header.Get("Connect-Timeout-Ms"))
+		if err == nil {
+			defer cancel()
+		}
+	}
+	if err == nil {
+		err = s.UnknownHandler(md.FullName(), cs)
+	}
+	if streaming {
+		cs.endStream(err)
+	} else {
+		cs.writeUnary(err)
+	}
+}
+
+func connectAcceptPost(streaming bool) string {
+	if streaming {
+		return connectStreamingPrefix + "json, " + connectStreamingPrefix + "proto"
+	}
+	return "application/json, application/proto"
+}
+
+// connectRequestError returns an error for Connect requests using features
+// that are not supported.
+func connectRequestError(r *http.Request) error {
+	for _, key := range []string{"Content-Encoding", "Connect-Content-Encoding"} {
+		if enc := r.Header.Get(key); enc != "" && enc != "identity" {
+			return status.Errorf(codes.Unimplemented, "unsupported compression %q", enc)
+		}
+	}
+	return nil
+}
+
+// connectTimeout returns ctx with the timeout of a Connect-Timeout-Ms
+// header.
+func connectTimeout(ctx context.Context, timeout string) (context.Context, context.CancelFunc, error) {
+	ms, err := strconv.ParseInt(timeout, 10, 64)
+	if err != nil || ms < 0 || len(timeout) > 10 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid Connect-Timeout-Ms %q", timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+	return ctx, cancel, nil
+}
+
+// connectMetadataKey returns the metadata key of a request header of a
+// Connect call, which is any header but those of the protocol itself.
+func connectMetadataKey(name string) (string, bool) {
+	key := strings.ToLower(name)
+	if strings.HasPrefix(key, "connect-") || key == "content-type" || key == "content-length" ||
+		key == "content-encoding" || key == "accept-encoding" || key == "te" {
+		return "", false
+	}
+	return key, true
+}
+
+// connectStream is a grpc.ServerStream of a Connect call. The response of
+// a unary call is buffered until the call returns. The responses of a
+// streaming call are written as they are sent.
+type connectStream struct {
+	ctx       context.Context
+	w         http.ResponseWriter
+	body      io.Reader
+	streaming bool
+	json      bool
+	reg       *registry.Files
+
+	header      metadata.MD
+	trailer     metadata.MD
+	wroteHeader bool
+	received    bool          // a unary request has been received
+	resp        proto.Message // the response of a unary call
+}
+
+var _ grpc.ServerStream = &connectStream{}
+
+func (s *connectStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *connectStream) SetHeader(md metadata.MD) error {
+	if s.wroteHeader {
+		return status.Error(codes.Internal, "header already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *connectStream) SendHeader(md metadata.MD) error {
+	if err := s.SetHeader(md); err != nil {
+		return err
+	}
+	if s.streaming {
+		s.writeHeader(http.StatusOK)
+	}
+	return nil
+}
+
+func (s *connectStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *connectStream) RecvMsg(m interface{}) error {
+	msg := m.(proto.Message)
+	if !s.streaming {
+		if s.received {
+			return io.EOF
+		}
+		s.received = true
+		b, err := io.ReadAll(io.LimitReader(s.body, MaxMessageSize+1))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot read request: %v", err)
+		}
+		if len(b) > MaxMessageSize {
+			return status.Errorf(codes.ResourceExhausted, "request larger than %d bytes", MaxMessageSize)
+		}
+		return s.unmarshal(b, msg)
+	}
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(s.body, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return status.Errorf(codes.InvalidArgument, "cannot read request envelope: %v", err)
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > MaxMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "request message larger than %d bytes", MaxMessageSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(s.body, b); err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot read request message: %v", err)
+	}
+	switch {
+	case prefix[0]&connectFlagEndStream != 0:
+		return io.EOF
+	case prefix[0]&connectFlagCompressed != 0:
+		return status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+	return s.unmarshal(b, msg)
+}
+
+func (s *connectStream) SendMsg(m interface{}) error {
+	msg := m.(proto.Message)
+	if !s.streaming {
+		if s.resp != nil {
+			return status.Error(codes.Internal, "only one response expected")
+		}
+		s.resp = msg
+		return nil
+	}
+	b, err := s.marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.writeHeader(http.StatusOK)
+	if err := s.writeEnvelope(0, b); err != nil {
+		return status.Errorf(codes.Unavailable, "cannot write response: %v", err)
+	}
+	return nil
+}
+
+func (s *connectStream) codec() string {
+	if s.json {
+		return "json"
+	}
+	return "proto"
+}
+
+func (s *connectStream) unmarshal(b []byte, m proto.Message) error {
+	var err error
+	if s.json {
+		err = protojson.UnmarshalOptions{Resolver: s.reg}.Unmarshal(b, m)
+	} else {
+		err = proto.Unmarshal(b, m)
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot decode request: %v", err)
+	}
+	return nil
+}
+
+func (s *connectStream) marshal(m proto.Message) ([]byte, error) {
+	var b []byte
+	var err error
+	if s.json {
+		b, err = protojson.MarshalOptions{Resolver: s.reg}.Marshal(m)
+	} else {
+		b, err = proto.Marshal(m)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot encode response: %v", err)
+	}
+	return b, nil
+}
+
+// writeHeader writes the response header with the header metadata of the
+// call, and the trailer metadata too for unary calls.
+func (s *connectStream) writeHeader(code int) {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+	h := s.w.Header()
+	setConnectMetadata(h, "", s.header)
+	if s.streaming {
+		h.Set("Content-Type", connectStreamingPrefix+s.codec())
+	} else {
+		setConnectMetadata(h, "Trailer-", s.trailer)
+	}
+	s.w.WriteHeader(code)
+}
+
+// writeUnary writes the response of a unary call, or its error.
+func (s *connectStream) writeUnary(err error) {
+	var b []byte
+	if err == nil && s.resp == nil {
+		err = status.Error(codes.Internal, "method returned no response")
+	}
+	if err == nil {
+		b, err = s.marshal(s.resp)
+	}
+	if err != nil {
+		b, _ = json.Marshal(newConnectError(err))
+		s.w.Header().Set("Content-Type", "application/json")
+		s.writeHeader(connectCodeOf(err).httpStatus)
+		s.w.Write(b) //nolint:errcheck
+		return
+	}
+	s.w.Header().Set("Content-Type", "application/"+s.codec())
+	s.writeHeader(http.StatusOK)
+	s.w.Write(b) //nolint:errcheck
+}
+
+// endStream writes the end-of-stream message of a streaming call, holding
+// its error, if any, and its trailer metadata.
+func (s *connectStream) endStream(err error) {
+	s.writeHeader(http.StatusOK)
+	end := struct {
+		Error    *connectError       `json:"error,omitempty"`
+		Metadata map[string][]string `json:"metadata,omitempty"`
+	}{}
+	if err != nil {
+		end.Error = newConnectError(err)
+	}
+	if s.trailer.Len() != 0 {
+		end.Metadata = map[string][]string{}
+		for key, values := range s.trailer {
+			for _, value := range values {
+				end.Metadata[key] = append(end.Metadata[key], connectMetadataValue(key, value))
+			}
+		}
+	}
+	b, _ := json.Marshal(end)
+	s.writeEnvelope(connectFlagEndStream, b) //nolint:errcheck
+}
+
+func (s *connectStream) writeEnvelope(flags byte, b []byte) error {
+	prefix := [5]byte{flags}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(b)))
+	if _, err := s.w.Write(append(prefix[:], b...)); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// setConnectMetadata adds the metadata md to h with keys prefixed by
+// prefix.
+func setConnectMetadata(h http.Header, prefix string, md metadata.MD) {
+	for key, values := range md {
+		for _, value := range values {
+			h.Add(prefix+key, connectMetadataValue(key, value))
+		}
+	}
+}
+
+// connectMetadataValue returns the value of the metadata key as sent in a
+// Connect response, base64 encoded for binary metadata.
+func connectMetadataValue(key, value string) string {
+	if strings.HasSuffix(key, "-bin") {
+		return base64.RawStdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+// connectError is the JSON representation of an error in the Connect
+// protocol.
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectErrorDetail struct {
+	// Type is the fully qualified name of the detail message type.
+	Type string `json:"type"`
+	// Value is the base64 encoded binary protobuf detail message.
+	Value string `json:"value"`
+}
+
+func newConnectError(err error) *connectError {
+	st := status.Convert(err)
+	ce := &connectError{Code: connectCodeOf(err).name, Message: st.Message()}
+	for _, detail := range st.Proto().GetDetails() {
+		typeName := detail.GetTypeUrl()[strings.LastIndex(detail.GetTypeUrl(), "/")+1:]
+		ce.Details = append(ce.Details, connectErrorDetail{
+			Type:  typeName,
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		})
+	}
+	return ce
+}
+
+func connectCodeOf(err error) connectCode {
+	if c, ok := connectCodes[status.Code(err)]; ok {
+		return c
+	}
+	return connectCodes[codes.Unknown]
+}
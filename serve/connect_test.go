@@ -0,0 +1,207 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func newConnectTestServer(t *testing.T) *TestServer {
+	t.Helper()
+	return NewInMemoryTestServer(t, JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithConnect())
+}
+
+func postConnect(t *testing.T, ts *TestServer, method, contentType string, header http.Header, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://jig/greet.Greeter/"+method, bytes.NewReader(body))
+	require.NoError(t, err)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := ts.HTTPClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, b
+}
+
+// connectEnvelopes encodes messages as the enveloped messages of a
+// streaming Connect request.
+func connectEnvelopes(msgs ...[]byte) []byte {
+	var b []byte
+	for _, msg := range msgs {
+		b = append(b, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(msg)))
+		b = append(b, msg...)
+	}
+	return b
+}
+
+// parseConnectEnvelopes decodes the enveloped messages of a streaming
+// Connect response, returning the messages and the end-of-stream message.
+func parseConnectEnvelopes(t *testing.T, b []byte) ([][]byte, string) {
+	t.Helper()
+	var msgs [][]byte
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 5)
+		flags, n := b[0], binary.BigEndian.Uint32(b[1:5])
+		msg := b[5 : 5+n]
+		b = b[5+n:]
+		if flags&connectFlagEndStream != 0 {
+			require.Empty(t, b, "end-of-stream message must be last")
+			return msgs, string(msg)
+		}
+		msgs = append(msgs, msg)
+	}
+	require.Fail(t, "missing end-of-stream message")
+	return nil, ""
+}
+
+func TestConnectUnary(t *testing.T) {
+	ts := newConnectTestServer(t)
+
+	resp, body := postConnect(t, ts, "Hello", "application/json", nil, []byte(`{"firstName": "🌏"}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello 🌏"}`, string(body))
+
+	req, err := proto.Marshal(&greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	resp, body = postConnect(t, ts, "Hello", "application/proto", nil, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, "application/proto", resp.Header.Get("Content-Type"))
+	msg := &greet.HelloResponse{}
+	require.NoError(t, proto.Unmarshal(body, msg))
+	require.Equal(t, "💃 jig [unary]: Hello 🌏", msg.Greeting)
+
+	call := ts.Journal.Calls(CallFilter{})[0]
+	require.Equal(t, "greet.Greeter.Hello", call.Method)
+}
+
+func TestConnectUnaryError(t *testing.T) {
+	ts := newConnectTestServer(t)
+
+	resp, body := postConnect(t, ts, "Hello", "application/json", nil, []byte(`{"firstName": "Bart"}`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, []string{"my", "shorts"}, resp.Header.Values("Eat"))
+	require.Equal(t, "cow", resp.Header.Get("Trailer-A"))
+
+	var ce connectError
+	require.NoError(t, json.Unmarshal(body, &ce))
+	require.Equal(t, "invalid_argument", ce.Code)
+	require.Equal(t, "💃 jig [unary]: eat my shorts", ce.Message)
+	require.Len(t, ce.Details, 2)
+	require.Equal(t, "google.protobuf.Duration", ce.Details[0].Type)
+	b, err := base64.RawStdEncoding.DecodeString(ce.Details[0].Value)
+	require.NoError(t, err)
+	d := &durationpb.Duration{}
+	require.NoError(t, proto.Unmarshal(b, d))
+	require.Equal(t, int64(42), d.Seconds)
+
+	resp, body = postConnect(t, ts, "Hello", "application/json", nil, []byte(`{"firstName": 1}`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(body, &ce))
+	require.Equal(t, "invalid_argument", ce.Code)
+
+	header := http.Header{"Content-Encoding": []string{"gzip"}}
+	resp, body = postConnect(t, ts, "Hello", "application/json", header, []byte(`{}`))
+	require.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(body, &ce))
+	require.Equal(t, "unimplemented", ce.Code)
+}
+
+func TestConnectStreaming(t *testing.T) {
+	ts := newConnectTestServer(t)
+
+	t.Run("server stream", func(t *testing.T) {
+		resp, body := postConnect(t, ts, "HelloServerStream", "application/connect+json", nil, connectEnvelopes([]byte(`{"firstName": "🌏"}`)))
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		require.Equal(t, "application/connect+json", resp.Header.Get("Content-Type"))
+		msgs, end := parseConnectEnvelopes(t, body)
+		require.Len(t, msgs, 2)
+		require.JSONEq(t, `{"greeting": "💃 jig [server]: Hello 🌏"}`, string(msgs[0]))
+		require.JSONEq(t, `{"greeting": "💃 jig [server]: Goodbye 🌏"}`, string(msgs[1]))
+		require.JSONEq(t, `{}`, end)
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		var reqs [][]byte
+		for _, name := range []string{"1", "2", "3"} {
+			b, err := proto.Marshal(&greet.HelloRequest{FirstName: name})
+			require.NoError(t, err)
+			reqs = append(reqs, b)
+		}
+		resp, body := postConnect(t, ts, "HelloClientStream", "application/connect+proto", nil, connectEnvelopes(reqs...))
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		require.Equal(t, "3", resp.Header.Get("Count"))
+		msgs, end := parseConnectEnvelopes(t, body)
+		require.Len(t, msgs, 1)
+		msg := &greet.HelloResponse{}
+		require.NoError(t, proto.Unmarshal(msgs[0], msg))
+		require.Equal(t, "💃 jig [client]: Hello 1 and 2 and 3", msg.Greeting)
+		require.JSONEq(t, `{"metadata": {"size": ["35"]}}`, end)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		resp, body := postConnect(t, ts, "HelloBidiStream", "application/connect+json", nil, connectEnvelopes([]byte(`{"firstName": "Bart"}`)))
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		require.Equal(t, []string{"his", "shorts"}, resp.Header.Values("Eat"))
+		msgs, end := parseConnectEnvelopes(t, body)
+		require.Empty(t, msgs)
+		require.JSONEq(t, `{"error": {"code": "invalid_argument", "message": "💃 jig [bidi]: eat my shorts"}}`, end)
+	})
+}
+
+func TestConnectHTTPHandler(t *testing.T) {
+	withHTTP := WithHTTPHandler(func(*Server) (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}), nil
+	})
+	ts := NewInMemoryTestServer(t, JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithConnect(), withHTTP)
+
+	// A JSON POST to a method path may be a plain HTTP request.
+	resp, _ := postConnect(t, ts, "Hello", "application/json", nil, []byte(`{"firstName": "🌏"}`))
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+	// Connect clients say so with a header or content type.
+	header := http.Header{"Connect-Protocol-Version": []string{"1"}}
+	resp, body := postConnect(t, ts, "Hello", "application/json", header, []byte(`{"firstName": "🌏"}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello 🌏"}`, string(body))
+
+	resp, body = postConnect(t, ts, "HelloServerStream", "application/connect+json", nil, connectEnvelopes([]byte(`{"firstName": "🌏"}`)))
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	msgs, _ := parseConnectEnvelopes(t, body)
+	require.Len(t, msgs, 2)
+}
+
+func TestConnectNotConnect(t *testing.T) {
+	ts := newConnectTestServer(t)
+
+	// A unary content type for a streaming method.
+	resp, _ := postConnect(t, ts, "HelloServerStream", "application/json", nil, []byte(`{}`))
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Accept-Post"), "application/connect+json"))
+
+	// Unknown methods and content types are not Connect calls.
+	resp, _ = postConnect(t, ts, "Missing", "application/json", nil, []byte(`{}`))
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = postConnect(t, ts, "Hello", "text/plain", nil, []byte(`{}`))
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,294 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"foxygo.at/jig/internal/cors"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	contentTypeGRPCWeb     = "application/grpc-web"
+	contentTypeGRPCWebText = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks the message frame holding the trailers of a
+	// gRPC-Web response.
+	grpcWebTrailerFlag = 0x80
+)
+
+// grpcWeb configures how a Server serves gRPC-Web requests.
+type grpcWeb struct {
+	// cors enables cross-origin requests from origins matching one of
+	// origins, or from any origin if origins is empty.
+	cors    bool
+	origins []string
+}
+
+// WithGRPCWeb is an Option to serve the gRPC-Web protocol used by browser
+// clients on the server's port, next to gRPC and HTTP. Both the binary
+// (application/grpc-web) and base64 text (application/grpc-web-text) modes
+// are supported, over HTTP/1.1 and HTTP/2.
+func WithGRPCWeb() Option {
+	return func(s *Server) error {
+		if s.grpcWeb == nil {
+			s.grpcWeb = &grpcWeb{}
+		}
+		return nil
+	}
+}
+
+// WithGRPCWebCORS is an Option to serve gRPC-Web, as with WithGRPCWeb, and
+// to allow cross-origin gRPC-Web calls from browser front ends served from
+// the given origins. An origin can contain a "*" wildcard, as in
+// "https://*.example.com". Without origins, or with "*", calls from any
+// origin are allowed, but without credentials such as cookies, which only
+// the given origins are allowed to send.
+func WithGRPCWebCORS(origins ...string) Option {
+	return func(s *Server) error {
+		s.grpcWeb = &grpcWeb{cors: true, origins: origins}
+		return nil
+	}
+}
+
+// isGRPCWebRequest returns true if r is a gRPC-Web call.
+func isGRPCWebRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.Method != http.MethodPost {
+		return false
+	}
+	mediaType = strings.TrimSuffix(mediaType, "+proto")
+	return mediaType == contentTypeGRPCWeb || mediaType == contentTypeGRPCWebText
+}
+
+// isGRPCWebPreflight returns true if r is a CORS preflight request for a
+// gRPC-Web call to one of the server's methods.
+func (s *Server) isGRPCWebPreflight(r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	// Convert /pkg.service/method -> pkg.service.method
+	name := strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/"), "/", ".")
+	return strings.Count(r.URL.Path, "/") == 2 && s.lookupMethod(protoreflect.FullName(name)) != nil
+}
+
+// serveGRPCWeb serves a gRPC-Web call by translating it to a gRPC call
+// served by the gRPC server, and the gRPC response back to gRPC-Web. The
+// trailers of the gRPC response are sent as the last message frame of the
+// gRPC-Web response body.
+func (s *Server) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	if s.grpcWeb.cors && !s.grpcWeb.setCORSHeaders(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	subtype, text := strings.CutPrefix(mediaType, contentTypeGRPCWebText)
+	if !text {
+		subtype = strings.TrimPrefix(mediaType, contentTypeGRPCWeb)
+	}
+
+	req := r.Clone(r.Context())
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	req.Header.Set("Content-Type", "application/grpc"+subtype)
+	req.Header.Del("Content-Length")
+	if text {
+		req.Body = io.NopCloser(&grpcWebTextReader{r: r.Body})
+	}
+	req.ContentLength = -1
+
+	gw := &grpcWebResponseWriter{w: w, header: http.Header{}, contentType: mediaType, text: text, cors: s.grpcWeb.cors}
+	s.gs.ServeHTTP(gw, req)
+	gw.writeTrailer()
+}
+
+// setCORSHeaders adds the CORS headers of the response to a cross-origin
+// request from an allowed origin. It returns false if the origin of a
+// cross-origin request is not allowed.
+func (g *grpcWeb) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !cors.AllowsOrigin(g.origins, origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if len(g.origins) != 0 && !slices.Contains(g.origins, "*") {
+		// Only origins configured explicitly are trusted with credentials.
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// servePreflight answers a CORS preflight request for a gRPC-Web call.
+func (g *grpcWeb) servePreflight(w http.ResponseWriter, r *http.Request) {
+	if !g.setCORSHeaders(w, r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", http.MethodPost)
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grpcWebTextReader decodes the base64 body of a grpc-web-text request.
+// Clients may encode each message frame separately, so padding can end any
+// chunk of the body rather than only the body itself. Each padded chunk is
+// decoded on its own.
+type grpcWebTextReader struct {
+	r   io.Reader
+	buf [4096]byte
+	in  []byte // base64 input not decoded yet
+	out []byte // decoded output not read yet
+	err error
+}
+
+func (t *grpcWebTextReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.err != nil {
+			if errors.Is(t.err, io.EOF) && len(t.in) != 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, t.err
+		}
+		var n int
+		n, t.err = t.r.Read(t.buf[:])
+		t.in = append(t.in, t.buf[:n]...)
+		if err := t.decode(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// decode decodes the complete 4 byte base64 quanta of the input, up to and
+// including each padded quantum separately.
+func (t *grpcWebTextReader) decode() error {
+	n := len(t.in) / 4 * 4
+	for src := t.in[:n]; len(src) > 0; {
+		end := len(src)
+		if i := bytes.IndexByte(src, '='); i >= 0 {
+			end = (i/4 + 1) * 4
+		}
+		b := make([]byte, base64.StdEncoding.DecodedLen(end))
+		m, err := base64.StdEncoding.Decode(b, src[:end])
+		if err != nil {
+			return err
+		}
+		t.out = append(t.out, b[:m]...)
+		src = src[end:]
+	}
+	t.in = append(t.in[:0], t.in[n:]...)
+	return nil
+}
+
+// grpcWebResponseWriter translates the gRPC response written by a gRPC
+// server to a gRPC-Web response. The header of the gRPC response is
+// buffered until it is written, so the trailers the gRPC server sets in it
+// afterwards can be written to the response body.
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	contentType string
+	text        bool
+	cors        bool
+
+	wroteHeader bool
+	trailers    []string // trailers declared in the gRPC response header
+}
+
+func (gw *grpcWebResponseWriter) Header() http.Header {
+	return gw.header
+}
+
+func (gw *grpcWebResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	h := gw.w.Header()
+	var exposed []string
+	for key, values := range gw.header {
+		if key == "Trailer" {
+			gw.trailers = append(gw.trailers, values...)
+			continue
+		}
+		h[key] = values
+		if len(values) > 0 && key != "Content-Type" {
+			exposed = append(exposed, key)
+		}
+	}
+	h.Set("Content-Type", gw.contentType)
+	if gw.cors {
+		// Let browser front ends read the header metadata and trailers
+		// sent as headers.
+		exposed = append(exposed, "Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin")
+		slices.Sort(exposed)
+		h.Set("Access-Control-Expose-Headers", strings.Join(slices.Compact(exposed), ", "))
+	}
+	gw.w.WriteHeader(code)
+}
+
+func (gw *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	gw.WriteHeader(http.StatusOK)
+	if !gw.text {
+		return gw.w.Write(b)
+	}
+	// Each write is encoded separately, with padding, so messages can be
+	// decoded as soon as they are received.
+	if _, err := io.WriteString(gw.w, base64.StdEncoding.EncodeToString(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush implements http.Flusher, which gRPC servers require.
+func (gw *grpcWebResponseWriter) Flush() {
+	gw.WriteHeader(http.StatusOK)
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeTrailer writes the trailers of the gRPC response as the trailer
+// frame of the gRPC-Web response body: the trailers declared in the header,
+// and those set with the http.TrailerPrefix.
+func (gw *grpcWebResponseWriter) writeTrailer() {
+	keys := make([]string, 0, len(gw.header))
+	for key := range gw.header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		name, ok := strings.CutPrefix(key, http.TrailerPrefix)
+		if !ok && !slices.Contains(gw.trailers, key) {
+			continue
+		}
+		for _, value := range gw.header[key] {
+			b.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+b.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(b.Len()))
+	frame = append(frame, b.String()...)
+	gw.Write(frame) //nolint: errcheck
+	gw.Flush()
+}
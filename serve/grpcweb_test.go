@@ -0,0 +1,222 @@
+package serve
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcWebResponse is a decoded gRPC-Web response body.
+type grpcWebResponse struct {
+	messages [][]byte
+	trailer  http.Header
+}
+
+func postGRPCWeb(t *testing.T, url, contentType string, header http.Header, msgs ...proto.Message) (*http.Response, grpcWebResponse) {
+	t.Helper()
+	// In text mode, each message frame is a base64 chunk of its own, as
+	// sent by browser clients.
+	text := strings.HasPrefix(contentType, contentTypeGRPCWebText)
+	var body []byte
+	for _, msg := range msgs {
+		b, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(b)))
+		frame = append(frame, b...)
+		if text {
+			frame = []byte(base64.StdEncoding.EncodeToString(frame))
+		}
+		body = append(body, frame...)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if text {
+		raw = decodeBase64Chunks(t, raw)
+	}
+
+	var result grpcWebResponse
+	for len(raw) > 0 {
+		require.GreaterOrEqual(t, len(raw), 5)
+		flag, n := raw[0], binary.BigEndian.Uint32(raw[1:5])
+		frame := raw[5 : 5+n]
+		raw = raw[5+n:]
+		if flag&grpcWebTrailerFlag == 0 {
+			result.messages = append(result.messages, frame)
+			continue
+		}
+		require.Empty(t, raw, "trailer frame must be last")
+		result.trailer = http.Header{}
+		for _, line := range strings.Split(strings.TrimSuffix(string(frame), "\r\n"), "\r\n") {
+			key, value, ok := strings.Cut(line, ": ")
+			require.True(t, ok, line)
+			result.trailer.Add(key, value)
+		}
+	}
+	require.NotNil(t, result.trailer, "missing trailer frame")
+	return resp, result
+}
+
+// decodeBase64Chunks decodes concatenated padded base64 chunks.
+func decodeBase64Chunks(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var result []byte
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, '=')
+		if end == -1 {
+			end = len(b)
+		}
+		for end < len(b) && b[end] == '=' {
+			end++
+		}
+		chunk, err := base64.StdEncoding.DecodeString(string(b[:end]))
+		require.NoError(t, err)
+		result = append(result, chunk...)
+		b = b[end:]
+	}
+	return result
+}
+
+func helloResponses(t *testing.T, resp grpcWebResponse) []string {
+	t.Helper()
+	var greetings []string
+	for _, b := range resp.messages {
+		msg := &greet.HelloResponse{}
+		require.NoError(t, proto.Unmarshal(b, msg))
+		greetings = append(greetings, msg.Greeting)
+	}
+	return greetings
+}
+
+func TestGRPCWeb(t *testing.T) {
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithGRPCWeb())
+	defer ts.Stop()
+	url := "http://" + ts.Addr() + "/greet.Greeter/"
+
+	for _, contentType := range []string{"application/grpc-web", "application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			resp, result := postGRPCWeb(t, url+"Hello", contentType, nil, &greet.HelloRequest{FirstName: "🌏"})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, contentType, resp.Header.Get("Content-Type"))
+			require.Equal(t, []string{"💃 jig [unary]: Hello 🌏"}, helloResponses(t, result))
+			require.Equal(t, "0", result.trailer.Get("grpc-status"))
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		resp, result := postGRPCWeb(t, url+"Hello", "application/grpc-web-text", nil, &greet.HelloRequest{FirstName: "Bart"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []string{"my", "shorts"}, resp.Header.Values("Eat"))
+		require.Empty(t, result.messages)
+		require.Equal(t, "3", result.trailer.Get("grpc-status"))
+		require.NotEmpty(t, result.trailer.Get("grpc-message"))
+		require.NotEmpty(t, result.trailer.Get("grpc-status-details-bin"))
+		require.Equal(t, "cow", result.trailer.Get("a"))
+		require.Equal(t, "have", result.trailer.Get("dont"))
+		require.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("server stream", func(t *testing.T) {
+		_, result := postGRPCWeb(t, url+"HelloServerStream", "application/grpc-web-text", nil, &greet.HelloRequest{FirstName: "🌏"})
+		want := []string{"💃 jig [server]: Hello 🌏", "💃 jig [server]: Goodbye 🌏"}
+		require.Equal(t, want, helloResponses(t, result))
+		require.Equal(t, "0", result.trailer.Get("grpc-status"))
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		// Both frames of the text body are padded base64 chunks.
+		msgs := []proto.Message{&greet.HelloRequest{FirstName: "1"}, &greet.HelloRequest{FirstName: "2"}}
+		_, result := postGRPCWeb(t, url+"HelloClientStream", "application/grpc-web-text", nil, msgs...)
+		require.Equal(t, []string{"💃 jig [client]: Hello 1 and 2"}, helloResponses(t, result))
+		require.Equal(t, "0", result.trailer.Get("grpc-status"))
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		_, result := postGRPCWeb(t, url+"Missing", "application/grpc-web", nil, &greet.HelloRequest{})
+		require.Equal(t, "12", result.trailer.Get("grpc-status"))
+	})
+
+	t.Run("no preflight without CORS", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodOptions, url+"Hello", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestGRPCWebCORS(t *testing.T) {
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithGRPCWebCORS("https://*.example.com"))
+	defer ts.Stop()
+	url := "http://" + ts.Addr() + "/greet.Greeter/Hello"
+
+	preflight := func(path, origin string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodOptions, "http://"+ts.Addr()+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("/greet.Greeter/Hello", "https://app.example.com")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "content-type,x-grpc-web", resp.Header.Get("Access-Control-Allow-Headers"))
+
+	resp = preflight("/greet.Greeter/Hello", "https://example.org")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("/greet.Greeter/Missing", "https://app.example.com")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	origin := http.Header{"Origin": []string{"https://app.example.com"}}
+	resp, result := postGRPCWeb(t, url, "application/grpc-web", origin, &greet.HelloRequest{FirstName: "Bart"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	exposed := resp.Header.Get("Access-Control-Expose-Headers")
+	require.Contains(t, exposed, "Eat")
+	require.Contains(t, exposed, "Grpc-Status")
+	require.Equal(t, "3", result.trailer.Get("grpc-status"))
+}
+
+func TestGRPCWebCORSAnyOrigin(t *testing.T) {
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithGRPCWebCORS())
+	defer ts.Stop()
+	url := "http://" + ts.Addr() + "/greet.Greeter/Hello"
+
+	origin := http.Header{"Origin": []string{"https://example.org"}}
+	resp, result := postGRPCWeb(t, url, "application/grpc-web", origin, &greet.HelloRequest{FirstName: "Kitty"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "https://example.org", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "0", result.trailer.Get("grpc-status"))
+}
@@ -0,0 +1,54 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// WithMethodHandler is an Option to implement the fully qualified method
+// (pkg.service.method) with a Go handler instead of the evaluator. The
+// handler is called by UnknownHandler, so calls to it are logged and
+// recorded in the Journal like evaluated calls, and it can be reached
+// through HTTP front ends such as httprule.Handler. The srv argument passed
+// to the handler is the protoreflect.FullName of the method.
+func WithMethodHandler(method string, handler grpc.StreamHandler) Option {
+	return func(s *Server) error {
+		if s.handlers == nil {
+			s.handlers = map[protoreflect.FullName]grpc.StreamHandler{}
+		}
+		s.handlers[protoreflect.FullName(method)] = handler
+		return nil
+	}
+}
+
+// UnaryHandler returns a grpc.StreamHandler for use with WithMethodHandler
+// that implements a unary method with a function taking and returning typed
+// messages, e.g. generated Go protobuf messages. The messages must be of the
+// method's input and output types.
+func UnaryHandler[Req, Resp proto.Message](fn func(context.Context, Req) (Resp, error)) grpc.StreamHandler {
+	return func(_ interface{}, ss grpc.ServerStream) error {
+		var req Req
+		req = req.ProtoReflect().Type().New().Interface().(Req)
+		if err := ss.RecvMsg(req); err != nil {
+			return err
+		}
+		resp, err := fn(ss.Context(), req)
+		if err != nil {
+			return err
+		}
+		return ss.SendMsg(resp)
+	}
+}
+
+func (s *Server) checkMethodHandlers() error {
+	for method := range s.handlers {
+		if s.lookupMethod(method) == nil {
+			return fmt.Errorf("method handler for unknown method %s", method)
+		}
+	}
+	return nil
+}
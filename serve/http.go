@@ -0,0 +1,127 @@
+package serve
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// MaxMessageSize is the size limit of the request messages of calls over the
+// HTTP based protocols, such as Connect and Twirp. It is the default limit
+// of gRPC servers.
+const MaxMessageSize = 4 << 20
+
+// HTTPStream is a grpc.ServerStream of a call transcoded from an HTTP
+// request, such as those created by the httprule package. Methods called
+// over an HTTPStream see the HTTP request in the "http" field of their
+// input, and can control the HTTP response with an "http" field in their
+// output. Over other streams, the "http" output field is ignored.
+type HTTPStream interface {
+	grpc.ServerStream
+	// HTTPRequest returns the HTTP request the call was transcoded from.
+	HTTPRequest() *HTTPRequest
+	// SetHTTPResponse sets the HTTP response controls of a method output.
+	// They only take effect if the HTTP response header has not been
+	// written yet.
+	SetHTTPResponse(*HTTPResponse)
+}
+
+// HTTPRequest describes the HTTP request of a call, as given to methods in
+// the "http" field of their input.
+type HTTPRequest struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Vars   map[string]string `json:"vars"`
+	Query  url.Values        `json:"query"`
+}
+
+// HTTPResponse holds the HTTP response controls of a method, set with the
+// "http" field of its output.
+type HTTPResponse struct {
+	// Status overrides the HTTP status code of the response if not zero.
+	Status int
+	// Header holds HTTP headers added to the response. Headers set here
+	// replace headers of the same name set by the transcoder.
+	Header http.Header
+	// Body, if not nil, is written as the raw response body of unary calls
+	// instead of the encoded response message or error status.
+	Body *string
+}
+
+// UnmarshalJSON unmarshals the "http" output field of a method. Header
+// values can be given as a string or a list of strings:
+//
+//	{"status": 201, "headers": {"Location": "/v1/books/1"}, "body": "created"}
+func (r *HTTPResponse) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Status  int                        `json:"status"`
+		Headers map[string]json.RawMessage `json:"headers"`
+		Body    *string                    `json:"body"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = HTTPResponse{Status: v.Status, Body: v.Body}
+	if v.Status != 0 && (v.Status < 100 || v.Status > 999) {
+		return fmt.Errorf("invalid http status %d", v.Status)
+	}
+	if len(v.Headers) > 0 {
+		r.Header = http.Header{}
+	}
+	for name, raw := range v.Headers {
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return fmt.Errorf("http header %s: must be a string or list of strings", name)
+			}
+			values = []string{value}
+		}
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	return nil
+}
+
+// httpStreamOf returns the HTTPStream of a call, if it was transcoded from
+// an HTTP request.
+func httpStreamOf(ss grpc.ServerStream) (HTTPStream, bool) {
+	if js, ok := ss.(*journalStream); ok {
+		ss = js.ServerStream
+	}
+	hs, ok := ss.(HTTPStream)
+	return hs, ok
+}
+
+// IncomingMetadata returns the headers of an HTTP request as the incoming
+// metadata of the call transcoded from it. metadataKey returns the metadata
+// key of a header name, or false if the header is not metadata. The values
+// of binary metadata keys, ending in "-bin", are base64 decoded, with or
+// without padding. Invalid binary values are dropped.
+func IncomingMetadata(header http.Header, metadataKey func(name string) (string, bool)) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range header {
+		key, ok := metadataKey(name)
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+				if err != nil {
+					continue
+				}
+				value = string(b)
+			}
+			md.Append(key, value)
+		}
+	}
+	return md
+}
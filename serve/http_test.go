@@ -0,0 +1,27 @@
+package serve
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestIncomingMetadata(t *testing.T) {
+	header := http.Header{
+		"Content-Type": []string{"application/json"},
+		"X-Session":    []string{"s1", "s2"},
+		"Echo-Bin":     []string{"AAE=", "AAE"},
+		"Bad-Bin":      []string{"!"},
+	}
+	metadataKey := func(name string) (string, bool) {
+		return strings.ToLower(name), name != "Content-Type"
+	}
+	want := metadata.MD{
+		"x-session": []string{"s1", "s2"},
+		"echo-bin":  []string{"\x00\x01", "\x00\x01"},
+	}
+	require.Equal(t, want, IncomingMetadata(header, metadataKey))
+}
@@ -0,0 +1,246 @@
+package httprule
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"foxygo.at/protog/registry"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// WithAutoRules is an [Option] to configure a [Handler] to derive HTTP rules
+// for methods without an HttpRule annotation from the resource-oriented
+// naming conventions of the API Improvement Proposals (https://google.aip.dev):
+//
+//	GetBook(name)            GET    /v1/{name=shelves/*/books/*}
+//	ListBooks(parent)        GET    /v1/{parent=shelves/*}/books
+//	CreateBook(parent, book) POST   /v1/{parent=shelves/*}/books     body: book
+//	UpdateBook(book)         PATCH  /v1/{book.name=shelves/*/books/*} body: book
+//	DeleteBook(name)         DELETE /v1/{name=shelves/*/books/*}
+//	ArchiveBook(name)        POST   /v1/{name=shelves/*/books/*}:archive body: *
+//
+// Resource name patterns come from the google.api.resource annotation of the
+// resource message. Without one, a resource is taken to be a top-level
+// collection named after the plural of the resource, e.g. "books/*", but
+// custom methods such as ArchiveBook are only derived for resources with a
+// google.api.resource pattern. The version prefix is the last component of
+// the proto package that looks like a version, such as "v1" or "v2beta1",
+// and "v1" otherwise. Methods whose name or request fields do not follow the
+// conventions fall back to the rule templates.
+func WithAutoRules() Option {
+	return func(h *Handler) error {
+		h.autoRules = true
+		return nil
+	}
+}
+
+var versionRegexp = regexp.MustCompile(`^v\d+(p\d+)?((alpha|beta)\d*)?$`)
+
+// autoRule returns the HTTP rule for method md derived from the AIP naming
+// conventions, or nil if md does not follow them.
+func autoRule(files *registry.Files, md protoreflect.MethodDescriptor) *annotations.HttpRule {
+	verb, noun := splitMethodName(string(md.Name()))
+	if noun == "" {
+		return nil
+	}
+	prefix := "/" + apiVersion(md.ParentFile().Package())
+	fields := md.Input().Fields()
+	switch verb {
+	case "List", "Create":
+		path := prefix + collectionPath(files, md, noun, fields.ByName("parent") != nil)
+		if verb == "List" {
+			return &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: path}}
+		}
+		body := "*"
+		if fd := fields.ByName(protoreflect.Name(snakeCase(noun))); fd != nil && fd.Message() != nil {
+			body = string(fd.Name())
+		}
+		return &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: path}, Body: body}
+	case "Update":
+		if fd := fields.ByName(protoreflect.Name(snakeCase(noun))); fd != nil && fd.Message() != nil && isStringField(fd.Message().Fields().ByName("name")) {
+			path := prefix + "/{" + string(fd.Name()) + ".name=" + resourcePattern(files, md, noun) + "}"
+			return &annotations.HttpRule{Pattern: &annotations.HttpRule_Patch{Patch: path}, Body: string(fd.Name())}
+		}
+	}
+	if !isStringField(fields.ByName("name")) {
+		return nil
+	}
+	path := prefix + "/{name=" + resourcePattern(files, md, noun) + "}"
+	switch verb {
+	case "Get":
+		return &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: path}}
+	case "Update":
+		return &annotations.HttpRule{Pattern: &annotations.HttpRule_Patch{Patch: path}, Body: "*"}
+	case "Delete":
+		return &annotations.HttpRule{Pattern: &annotations.HttpRule_Delete{Delete: path}}
+	}
+	if resourceNamePattern(findResource(files, md, noun)) == "" {
+		// Any method name could be a verb and a noun, so custom methods
+		// are only derived for known resources.
+		return nil
+	}
+	return &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: path + ":" + lowerFirst(verb)}, Body: "*"}
+}
+
+// splitMethodName splits a method name into its leading verb and the noun
+// that follows, e.g. "GetBook" into "Get" and "Book".
+func splitMethodName(name string) (verb, noun string) {
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			return name[:i], name[i:]
+		}
+	}
+	return name, ""
+}
+
+// apiVersion returns the version component of a proto package, or "v1".
+func apiVersion(pkg protoreflect.FullName) string {
+	parts := strings.Split(string(pkg), ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if versionRegexp.MatchString(parts[i]) {
+			return parts[i]
+		}
+	}
+	return "v1"
+}
+
+// resourcePattern returns the path template of the names of resource noun,
+// such as "shelves/*/books/*" for "Book".
+func resourcePattern(files *registry.Files, md protoreflect.MethodDescriptor, noun string) string {
+	if pattern := resourceNamePattern(findResource(files, md, noun)); pattern != "" {
+		return pattern
+	}
+	return lowerFirst(plural(noun)) + "/*"
+}
+
+// collectionPath returns the path of the collection of resources listed or
+// created by md, such as "/{parent=shelves/*}/books" for "Books" or "Book".
+// The path has a parent variable only if hasParent is true and the resource
+// is not a top-level resource.
+func collectionPath(files *registry.Files, md protoreflect.MethodDescriptor, noun string, hasParent bool) string {
+	// List methods are named after the plural of the resource, others after
+	// the resource.
+	var pattern, collection string
+	if strings.HasPrefix(string(md.Name()), "List") {
+		pattern, collection = resourceNamePattern(listedResource(md.Output())), noun
+	} else {
+		pattern, collection = resourceNamePattern(findResource(files, md, noun)), plural(noun)
+	}
+	if pattern == "" {
+		return "/" + lowerFirst(collection)
+	}
+	segments := strings.Split(pattern, "/")
+	if len(segments) < 2 {
+		return "/" + pattern
+	}
+	collection = segments[len(segments)-2]
+	if parent := strings.Join(segments[:len(segments)-2], "/"); parent != "" && hasParent {
+		return "/{parent=" + parent + "}/" + collection
+	}
+	return "/" + collection
+}
+
+// findResource returns the resource message named noun: the output of md,
+// a request field of md, or a message in the package of md.
+func findResource(files *registry.Files, md protoreflect.MethodDescriptor, noun string) protoreflect.MessageDescriptor {
+	name := protoreflect.Name(noun)
+	if md.Output().Name() == name {
+		return md.Output()
+	}
+	if fd := md.Input().Fields().ByName(protoreflect.Name(snakeCase(noun))); fd != nil && fd.Message() != nil && fd.Message().Name() == name {
+		return fd.Message()
+	}
+	if files == nil {
+		return nil
+	}
+	desc, err := files.FindDescriptorByName(md.ParentFile().Package().Append(name))
+	if err != nil {
+		return nil
+	}
+	resource, _ := desc.(protoreflect.MessageDescriptor)
+	return resource
+}
+
+// listedResource returns the message type of the first repeated message
+// field of a List method response, or nil if there is none.
+func listedResource(response protoreflect.MessageDescriptor) protoreflect.MessageDescriptor {
+	fields := response.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if fd := fields.Get(i); fd.IsList() && fd.Message() != nil {
+			return fd.Message()
+		}
+	}
+	return nil
+}
+
+// resourceNamePattern returns the first name pattern of the google.api.resource
+// annotation of md as a path template, such as "shelves/*/books/*" for
+// "shelves/{shelf}/books/{book}", or "" if there is none.
+func resourceNamePattern(md protoreflect.MessageDescriptor) string {
+	if md == nil {
+		return ""
+	}
+	var pattern string
+	md.Options().ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if fd.Kind() == protoreflect.MessageKind {
+			if resource, ok := value.Message().Interface().(*annotations.ResourceDescriptor); ok && len(resource.Pattern) != 0 {
+				pattern = resource.Pattern[0]
+				return false
+			}
+		}
+		return true
+	})
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isStringField(fd protoreflect.FieldDescriptor) bool {
+	return fd != nil && fd.Kind() == protoreflect.StringKind && !fd.IsList()
+}
+
+// plural returns the English plural of a noun, e.g. "Shelves" for "Shelf".
+func plural(noun string) string {
+	lower := strings.ToLower(noun)
+	switch {
+	case strings.HasSuffix(lower, "y") && !strings.ContainsAny(lower[max(len(lower)-2, 0):len(lower)-1], "aeiou"):
+		return noun[:len(noun)-1] + "ies"
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"), strings.HasSuffix(lower, "z"),
+		strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return noun + "es"
+	case strings.HasSuffix(lower, "f"):
+		return noun[:len(noun)-1] + "ves"
+	case strings.HasSuffix(lower, "fe"):
+		return noun[:len(noun)-2] + "ves"
+	}
+	return noun + "s"
+}
+
+// snakeCase converts a CamelCase name to snake_case, e.g. "BookShelf" to
+// "book_shelf".
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
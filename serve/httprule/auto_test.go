@@ -0,0 +1,121 @@
+package httprule
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/serve"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestAutoRules(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/library"), serve.WithLogger(log.DiscardLogger))
+	tmpl := []*annotations.HttpRule{{Pattern: &annotations.HttpRule_Post{Post: "/{package}.{service}/{method}"}, Body: "*"}}
+	h, err := NewHandler(ts.Files, nil, WithLogger(log.DiscardLogger), WithAutoRules(), WithRuleTemplates(tmpl))
+	require.NoError(t, err)
+
+	got := map[string]string{}
+	for _, m := range h.httpMethods {
+		_, path := extractSelect(m.rule)
+		got[string(m.desc.Name())] = strings.TrimSpace(m.httpMethod + " " + path + " " + m.rule.Body)
+	}
+	want := map[string]string{
+		"GetShelf":    "GET /v1/{name=shelves/*}",
+		"ListShelves": "GET /v1/shelves",
+		"GetBook":     "GET /v1/{name=shelves/*/books/*}",
+		"ListBooks":   "GET /v1/{parent=shelves/*}/books",
+		"CreateBook":  "POST /v1/{parent=shelves/*}/books book",
+		"UpdateBook":  "PATCH /v1/{book.name=shelves/*/books/*} book",
+		"DeleteBook":  "DELETE /v1/{name=shelves/*/books/*}",
+		"ArchiveBook": "POST /v1/{name=shelves/*/books/*}:archive *",
+		"Recommend":   "POST /library.Library/Recommend *",
+	}
+	require.Equal(t, want, got)
+}
+
+func TestAutoRuleCustomMethod(t *testing.T) {
+	// SayHello has a name field, but Hello is not a resource.
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("hello.proto"),
+		Package: proto.String("hello.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("SayHelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{{Name: proto.String("name"), Number: proto.Int32(1), Type: str}}},
+			{Name: proto.String("SayHelloResponse")},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("SayHello"), InputType: proto.String(".hello.v1.SayHelloRequest"), OutputType: proto.String(".hello.v1.SayHelloResponse")}},
+		}},
+	}
+	fd, err := protodesc.NewFile(fdp, nil)
+	require.NoError(t, err)
+	require.Nil(t, autoRule(nil, fd.Services().Get(0).Methods().ByName("SayHello")))
+}
+
+func TestAutoRulesHTTP(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/library"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(WithAutoRules()))
+
+	do := func(method, path, body string) string {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://jig"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+		return string(raw)
+	}
+	require.JSONEq(t, `{"name": "shelves/scifi", "theme": "Science fiction"}`, do("GET", "/v1/shelves/scifi", ""))
+	require.JSONEq(t, `{"books": [{"name": "shelves/scifi/books/dune", "title": "Dune"}]}`, do("GET", "/v1/shelves/scifi/books", ""))
+	require.JSONEq(t, `{"name": "shelves/scifi/books/dune", "title": "Dune"}`, do("POST", "/v1/shelves/scifi/books?bookId=dune", `{"title": "Dune"}`))
+	require.JSONEq(t, `{"name": "shelves/scifi/books/dune", "title": "Dune Messiah"}`, do("PATCH", "/v1/shelves/scifi/books/dune", `{"title": "Dune Messiah"}`))
+	require.JSONEq(t, `{"name": "shelves/scifi/books/dune", "title": "Archived"}`, do("POST", "/v1/shelves/scifi/books/dune:archive", `{}`))
+}
+
+func TestAutoRuleNames(t *testing.T) {
+	verb, noun := splitMethodName("BatchGetBooks")
+	require.Equal(t, "Batch", verb)
+	require.Equal(t, "GetBooks", noun)
+	verb, noun = splitMethodName("Recommend")
+	require.Equal(t, "Recommend", verb)
+	require.Equal(t, "", noun)
+
+	for pkg, want := range map[string]string{
+		"library":                     "v1",
+		"google.example.library.v2":   "v2",
+		"acme.v1beta1.inner":          "v1beta1",
+		"acme.v1p1alpha":              "v1p1alpha",
+		"acme.version":                "v1",
+		"google.cloud.translation.v3": "v3",
+	} {
+		require.Equal(t, want, apiVersion(protoreflect.FullName(pkg)), pkg)
+	}
+
+	for noun, want := range map[string]string{
+		"Book":    "Books",
+		"Shelf":   "Shelves",
+		"Library": "Libraries",
+		"Day":     "Days",
+		"Box":     "Boxes",
+		"Address": "Addresses",
+		"Branch":  "Branches",
+	} {
+		require.Equal(t, want, plural(noun), noun)
+	}
+
+	require.Equal(t, "book_shelf", snakeCase("BookShelf"))
+	require.Equal(t, "bookShelf", lowerFirst("BookShelf"))
+}
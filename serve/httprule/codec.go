@@ -0,0 +1,288 @@
+package httprule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// WithProtoJSONOptions is an [Option] to configure how a [Handler] encodes
+// messages as JSON and YAML, for example to use proto field names instead
+// of JSON field names, to emit unpopulated fields or to write enums as
+// numbers.
+func WithProtoJSONOptions(opts protojson.MarshalOptions) Option {
+	return func(h *Handler) error {
+		h.marshaler.json = opts
+		return nil
+	}
+}
+
+// marshaler encodes messages as the media types of HTTP responses.
+type marshaler struct {
+	json protojson.MarshalOptions
+}
+
+// marshal encodes m as mediaType. The streaming JSON framings (NDJSON and
+// server-sent events) encode each message as JSON.
+func (mo marshaler) marshal(mediaType string, m proto.Message) ([]byte, error) {
+	switch mediaType {
+	case ContentTypeBinaryProto:
+		return proto.Marshal(m)
+	case ContentTypeJSON, ContentTypeNDJSON, ContentTypeEventStream:
+		return mo.json.Marshal(m)
+	case ContentTypeTextProto:
+		return prototext.MarshalOptions{Multiline: true}.Marshal(m)
+	case ContentTypeYAML:
+		b, err := mo.json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return jsonToYAML(b)
+	}
+	return nil, fmt.Errorf("invalid content type %s", mediaType)
+}
+
+// marshalResponse marshals the response message m as mediaType. If
+// responseBody is set, only that top-level field of m is marshaled. A
+// non-message field can only be marshaled as JSON or YAML.
+func (mo marshaler) marshalResponse(responseBody, mediaType string, m proto.Message) ([]byte, error) {
+	if responseBody == "" {
+		return mo.marshal(mediaType, m)
+	}
+	mr := m.ProtoReflect()
+	fd := findField(mr.Descriptor(), responseBody)
+	if fd == nil {
+		return nil, fmt.Errorf("response body field %s: %w", responseBody, errNoSuchField)
+	}
+	if isMessageField(fd) {
+		return mo.marshal(mediaType, mr.Get(fd).Message().Interface())
+	}
+	if !isJSONType(mediaType) && mediaType != ContentTypeYAML {
+		return nil, fmt.Errorf("cannot marshal non-message response body field %s as %s", responseBody, mediaType)
+	}
+	// Marshal a message with only the field set and extract the field, so
+	// protojson handles the field type. An unset field is marshaled as its
+	// zero value.
+	tmp := mr.New()
+	if mr.Has(fd) {
+		tmp.Set(fd, mr.Get(fd))
+	}
+	jo := mo.json
+	jo.EmitUnpopulated = jo.EmitUnpopulated || !mr.Has(fd)
+	b, err := jo.Marshal(tmp.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	key := fd.JSONName()
+	if jo.UseProtoNames {
+		key = string(fd.Name())
+	}
+	if mediaType == ContentTypeYAML {
+		return jsonToYAML(fields[key])
+	}
+	return fields[key], nil
+}
+
+func isJSONType(mediaType string) bool {
+	return mediaType == ContentTypeJSON || mediaType == ContentTypeNDJSON || mediaType == ContentTypeEventStream
+}
+
+// unaryMediaTypes and streamingMediaTypes are the media types responses of
+// unary and server-streaming methods can be encoded as, in order of
+// preference when a client accepts several of them equally.
+var (
+	unaryMediaTypes = []string{
+		ContentTypeJSON,
+		ContentTypeBinaryProto,
+		ContentTypeTextProto,
+		ContentTypeYAML,
+	}
+	streamingMediaTypes = []string{
+		ContentTypeJSON,
+		ContentTypeNDJSON,
+		ContentTypeEventStream,
+		ContentTypeBinaryProto,
+		ContentTypeYAML,
+	}
+)
+
+// getAcceptType negotiates the media type to encode the response of r with
+// from its Accept header. Without an Accept header, the response is encoded
+// as JSON, or as the request Content-Type if fromContentType is true and
+// the response can be encoded as it. getAcceptType returns an error if r
+// accepts none of the media types the response can be encoded as.
+func getAcceptType(r *http.Request, streaming, fromContentType bool) (string, error) {
+	offers := unaryMediaTypes
+	if streaming {
+		offers = streamingMediaTypes
+	}
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		if fromContentType {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil && mediaType == ContentTypeNDJSON && !streaming {
+				// A streamed request body does not imply a streamed response.
+				mediaType = ContentTypeJSON
+			}
+			if err == nil && slices.Contains(offers, mediaType) {
+				return mediaType, nil
+			}
+		}
+		return ContentTypeJSON, nil
+	}
+	if mediaType := negotiate(parseAccept(accept), offers); mediaType != "" {
+		return mediaType, nil
+	}
+	return "", fmt.Errorf("none of the accepted content types %q is supported", accept)
+}
+
+// acceptsExplicitly returns true if the Accept header of r names
+// mediaType, rather than accepting it through a wildcard range.
+func acceptsExplicitly(r *http.Request, mediaType string) bool {
+	for _, mr := range parseAccept(strings.Join(r.Header.Values("Accept"), ",")) {
+		if mr.typ+"/"+mr.subtype == mediaType && mr.q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaRange is an element of an Accept header, such as "text/*;q=0.5".
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses the media ranges of an Accept header. Invalid ranges
+// are ignored.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, s := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || (typ == "*" && subtype != "*") {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+	}
+	return ranges
+}
+
+// negotiate returns the offered media type with the highest quality in
+// ranges, or "" if no offer is acceptable. The quality of an offer is that
+// of the most specific range matching it. Ties go to the offer matched by
+// the more specific range, then by the range listed first, then to the
+// offer listed first.
+func negotiate(ranges []mediaRange, offers []string) string {
+	best, bestQ, bestSpecificity, bestIndex := "", 0.0, -1, 0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+		q, specificity, index := 0.0, -1, 0
+		for i, r := range ranges {
+			s := -1
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 2
+			case r.typ == typ && r.subtype == "*":
+				s = 1
+			case r.typ == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity, index = r.q, s, i
+			}
+		}
+		if q == 0 {
+			continue
+		}
+		better := q > bestQ ||
+			(q == bestQ && specificity > bestSpecificity) ||
+			(q == bestQ && specificity == bestSpecificity && index < bestIndex)
+		if better {
+			best, bestQ, bestSpecificity, bestIndex = offer, q, specificity, index
+		}
+	}
+	return best
+}
+
+// jsonToYAML converts JSON to block style YAML, keeping the order of object
+// members.
+func jsonToYAML(b []byte) ([]byte, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal(b, &n); err != nil {
+		return nil, err
+	}
+	var clearStyle func(*yaml.Node)
+	clearStyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, c := range n.Content {
+			clearStyle(c)
+		}
+	}
+	clearStyle(&n)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&n); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlToJSON converts a YAML document to JSON.
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue converts the maps of a decoded YAML value with non-string
+// keys, such as those of protobuf maps with integer keys, to maps with
+// string keys so they can be marshaled as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = jsonValue(value)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,153 @@
+package httprule
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+
+	"foxygo.at/jig/pb/exemplar"
+)
+
+func TestMarshalResponse(t *testing.T) {
+	msg := &exemplar.SampleResponse{
+		AString:  "str",
+		AMessage: &exemplar.SampleResponse_SampleMessage1{Field: "f"},
+		AIntList: []int32{1, 2},
+	}
+	tests := map[string]struct {
+		responseBody string
+		want         string
+	}{
+		"whole message": {"", `{"aString": "str", "aMessage": {"field": "f"}, "aIntList": [1, 2]}`},
+		"message field": {"a_message", `{"field": "f"}`},
+		"scalar field":  {"a_string", `"str"`},
+		"json name":     {"aIntList", `[1, 2]`},
+		"unset field":   {"a_int32", `0`},
+		"unset message": {"recursive", `{}`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := marshaler{}.marshalResponse(tc.responseBody, ContentTypeJSON, msg)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.want, string(got))
+		})
+	}
+
+	got, err := marshaler{}.marshalResponse("a_message", ContentTypeBinaryProto, msg)
+	require.NoError(t, err)
+	sub := &exemplar.SampleResponse_SampleMessage1{}
+	require.NoError(t, proto.Unmarshal(got, sub))
+	require.Equal(t, "f", sub.Field)
+
+	_, err = marshaler{}.marshalResponse("a_string", ContentTypeBinaryProto, msg)
+	require.Error(t, err)
+	_, err = marshaler{}.marshalResponse("no_such_field", ContentTypeJSON, msg)
+	require.Error(t, err)
+}
+
+func TestMarshalFormats(t *testing.T) {
+	msg := &exemplar.SampleResponse{
+		AString:  "str",
+		AEnum:    exemplar.SampleResponse_SAMPLE_ENUM_FIRST,
+		AIntList: []int32{1, 2},
+	}
+
+	got, err := marshaler{}.marshal(ContentTypeYAML, msg)
+	require.NoError(t, err)
+	require.Equal(t, "aString: str\naEnum: SAMPLE_ENUM_FIRST\naIntList:\n  - 1\n  - 2\n", string(got))
+
+	got, err = marshaler{}.marshalResponse("a_int_list", ContentTypeYAML, msg)
+	require.NoError(t, err)
+	require.Equal(t, "- 1\n- 2\n", string(got))
+
+	got, err = marshaler{}.marshal(ContentTypeTextProto, msg)
+	require.NoError(t, err)
+	fromText := &exemplar.SampleResponse{}
+	require.NoError(t, prototext.Unmarshal(got, fromText))
+	require.True(t, proto.Equal(msg, fromText))
+
+	mo := marshaler{json: protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true}}
+	got, err = mo.marshal(ContentTypeJSON, msg)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a_string": "str", "a_enum": 1, "a_int_list": [1, 2]}`, string(got))
+	got, err = mo.marshalResponse("a_enum", ContentTypeJSON, msg)
+	require.NoError(t, err)
+	require.JSONEq(t, `1`, string(got))
+
+	_, err = marshaler{}.marshalResponse("a_string", ContentTypeTextProto, msg)
+	require.Error(t, err)
+}
+
+func TestUnmarshalFormats(t *testing.T) {
+	tests := map[string]struct {
+		body      string
+		mediaType string
+		raw       string
+	}{
+		"YAML":              {"*", ContentTypeYAML, "aString: str\na_message:\n  field: f\n"},
+		"YAML field":        {"a_message", ContentTypeYAML, "field: f\n"},
+		"text format":       {"*", ContentTypeTextProto, `a_string: "str" a_message { field: "f" }`},
+		"text format field": {"a_message", ContentTypeTextProto, `field: "f"`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := &exemplar.SampleResponse{}
+			require.NoError(t, unmarshalBody(tc.body, tc.mediaType, []byte(tc.raw), got))
+			require.Equal(t, "f", got.GetAMessage().GetField())
+			if tc.body == "*" {
+				require.Equal(t, "str", got.AString)
+			}
+		})
+	}
+	err := unmarshalBody("a_string", ContentTypeTextProto, []byte(`"str"`), &exemplar.SampleResponse{})
+	require.Error(t, err)
+}
+
+func TestGetAcceptType(t *testing.T) {
+	tests := map[string]struct {
+		accept      string
+		contentType string
+		streaming   bool
+		want        string
+	}{
+		"default":                {"", "", false, ContentTypeJSON},
+		"any":                    {"*/*", "", false, ContentTypeJSON},
+		"parameters":             {"application/x-protobuf; charset=utf-8", "", false, ContentTypeBinaryProto},
+		"list":                   {"application/xml, application/yaml", "", false, ContentTypeYAML},
+		"q-values":               {"application/json;q=0.5, text/x-protobuf;q=0.8", "", false, ContentTypeTextProto},
+		"excluded":               {"application/json;q=0, */*", "", false, ContentTypeBinaryProto},
+		"subtype wildcard":       {"text/*", "", false, ContentTypeTextProto},
+		"specific over wildcard": {"*/*;q=0.5, application/yaml", "", false, ContentTypeYAML},
+		"first listed on tie":    {"application/yaml, application/json", "", false, ContentTypeYAML},
+		"invalid ranges ignored": {"application/json;q=2, ;;, application/x-protobuf", "", false, ContentTypeBinaryProto},
+		"streaming":              {"text/*", "", true, ContentTypeEventStream},
+		"stream framing unary":   {"application/x-ndjson", "", false, ""},
+		"not acceptable":         {"application/xml", "", false, ""},
+		"from content type":      {"", "application/yaml", false, ContentTypeYAML},
+		"ndjson request":         {"", ContentTypeNDJSON, false, ContentTypeJSON},
+		"ndjson stream":          {"", ContentTypeNDJSON, true, ContentTypeNDJSON},
+		"unknown content type":   {"", "image/png", false, ContentTypeJSON},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			got, err := getAcceptType(req, tc.streaming, true)
+			if tc.want == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
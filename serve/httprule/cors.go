@@ -0,0 +1,125 @@
+package httprule
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"foxygo.at/jig/internal/cors"
+)
+
+// CORS configures the Cross-Origin Resource Sharing headers a [Handler]
+// responds with, allowing browser front ends served from other origins to
+// call its methods. The zero value allows requests from any origin with
+// any headers and methods of the routes matching the request path.
+type CORS struct {
+	// AllowedOrigins are the origins allowed to make cross-origin
+	// requests, such as "https://example.com". An origin can contain a "*"
+	// wildcard, as in "https://*.example.com", and "*" allows any origin.
+	// If empty, any origin is allowed.
+	AllowedOrigins []string
+	// AllowedHeaders are the request headers allowed in cross-origin
+	// requests. "*" allows any header. If empty, any header is allowed.
+	AllowedHeaders []string
+	// AllowedMethods restricts the HTTP methods allowed in cross-origin
+	// requests. If empty, the HTTP methods of all routes matching the
+	// request path are allowed.
+	AllowedMethods []string
+	// ExposedHeaders are the response headers browsers expose to front
+	// ends in addition to the CORS-safelisted ones, such as the
+	// "Grpc-Metadata-" headers of a method's header metadata.
+	ExposedHeaders []string
+	// AllowCredentials allows cross-origin requests with credentials, such
+	// as cookies.
+	AllowCredentials bool
+	// MaxAge is how long browsers can cache the response of a preflight
+	// request, if not zero.
+	MaxAge time.Duration
+}
+
+// WithCORS is an [Option] to configure a [Handler] to answer CORS preflight
+// requests for the routes matching their path, and to add CORS headers to
+// the responses of cross-origin requests from allowed origins.
+func WithCORS(cors CORS) Option {
+	return func(h *Handler) error {
+		h.cors = &cors
+		return nil
+	}
+}
+
+// serveCORS adds the CORS response headers to requests from allowed
+// origins. It answers preflight requests whose path matches a route and
+// returns true if it did so.
+func (h *Handler) serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if origin == "" || !h.cors.allowsOrigin(origin) {
+		return false
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	var methods []string
+	if preflight {
+		routeMethods := h.router.methods(r.URL.EscapedPath())
+		if len(routeMethods) == 0 {
+			// Not a route of ours, so not a preflight request for us.
+			return false
+		}
+		methods = h.cors.allowedMethods(routeMethods)
+	}
+	if slices.Contains(h.cors.AllowedOrigins, "*") && !h.cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if h.cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(h.cors.ExposedHeaders) != 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(h.cors.ExposedHeaders, ", "))
+		}
+		return false
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers := h.cors.allowedHeaders(r.Header.Get("Access-Control-Request-Headers")); headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if h.cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(h.cors.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	return cors.AllowsOrigin(c.AllowedOrigins, origin)
+}
+
+// allowedMethods returns the HTTP methods of the routes matching a path
+// that are allowed for cross-origin requests.
+func (c *CORS) allowedMethods(routeMethods []string) []string {
+	if len(c.AllowedMethods) == 0 {
+		return routeMethods
+	}
+	var methods []string
+	for _, m := range routeMethods {
+		if slices.ContainsFunc(c.AllowedMethods, func(allowed string) bool { return strings.EqualFold(m, allowed) }) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// allowedHeaders returns the value of the Access-Control-Allow-Headers
+// response header for the requested headers.
+func (c *CORS) allowedHeaders(requested string) string {
+	if len(c.AllowedHeaders) == 0 || slices.Contains(c.AllowedHeaders, "*") {
+		return requested
+	}
+	return strings.Join(c.AllowedHeaders, ", ")
+}
@@ -0,0 +1,97 @@
+package httprule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	r := newTestRouter(t,
+		getRule("/v1/books/{id}"),
+		postRule("/v1/books/{id}"),
+		getRule("/v1/{name=**}"),
+	)
+	teapot := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	serve := func(cors CORS, method, path string, header map[string]string) *http.Response {
+		t.Helper()
+		h := &Handler{router: *r, cors: &cors, defaultHandler: teapot}
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+	preflight := map[string]string{
+		"Origin":                         "https://example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type, x-jig-session",
+	}
+
+	t.Run("preflight", func(t *testing.T) {
+		resp := serve(CORS{}, http.MethodOptions, "/v1/books/1", preflight)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+		require.Equal(t, "content-type, x-jig-session", resp.Header.Get("Access-Control-Allow-Headers"))
+		require.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+		require.Empty(t, resp.Header.Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("preflight with options", func(t *testing.T) {
+		cors := CORS{
+			AllowedOrigins:   []string{"https://other.com", "https://*example.com"},
+			AllowedHeaders:   []string{"Content-Type"},
+			AllowedMethods:   []string{"post", "PUT"},
+			AllowCredentials: true,
+			MaxAge:           time.Hour,
+		}
+		resp := serve(cors, http.MethodOptions, "/v1/books/1", preflight)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "POST", resp.Header.Get("Access-Control-Allow-Methods"))
+		require.Equal(t, "Content-Type", resp.Header.Get("Access-Control-Allow-Headers"))
+		require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+		require.Equal(t, "3600", resp.Header.Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("preflight of other routes", func(t *testing.T) {
+		resp := serve(CORS{}, http.MethodOptions, "/v1/shelves/1", preflight)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.Equal(t, "GET", resp.Header.Get("Access-Control-Allow-Methods"))
+
+		resp = serve(CORS{}, http.MethodOptions, "/v2/books/1", preflight)
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		cors := CORS{AllowedOrigins: []string{"https://other.com"}}
+		resp := serve(cors, http.MethodOptions, "/v1/books/1", preflight)
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "Origin", resp.Header.Get("Vary"))
+	})
+
+	t.Run("request", func(t *testing.T) {
+		cors := CORS{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"Grpc-Metadata-Eat"}}
+		header := map[string]string{"Origin": "https://example.com"}
+		resp := serve(cors, http.MethodPut, "/v1/books/1", header)
+		require.Equal(t, http.StatusTeapot, resp.StatusCode)
+		require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "Grpc-Metadata-Eat", resp.Header.Get("Access-Control-Expose-Headers"))
+		require.Empty(t, resp.Header.Get("Access-Control-Allow-Methods"))
+
+		cors.AllowCredentials = true
+		resp = serve(cors, http.MethodPut, "/v1/books/1", header)
+		require.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	})
+}
@@ -0,0 +1,190 @@
+package httprule
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"foxygo.at/protog/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// NewGateway returns a new [Handler] that transcodes HTTP requests matching
+// the HTTP rules of the methods in files to gRPC calls on conn, typically a
+// connection to a remote gRPC server. Only the descriptors of the methods
+// are needed; no generated code is.
+func NewGateway(files *registry.Files, conn grpc.ClientConnInterface, options ...Option) (*Handler, error) {
+	return NewHandler(files, ForwardingHandler(files, conn), options...)
+}
+
+// ForwardingHandler returns a [grpc.StreamHandler] that forwards calls to
+// conn. Request and response messages are decoded and encoded using the
+// method descriptors in files. The incoming metadata of a call is sent as
+// its outgoing metadata, and the header and trailer metadata of the
+// forwarded call are set on the incoming stream.
+//
+// The method called is taken from srv if it is a [protoreflect.FullName], as
+// passed by a [Handler], or from the stream context otherwise, so the
+// handler can also be used as the unknown service handler of a gRPC server.
+func ForwardingHandler(files *registry.Files, conn grpc.ClientConnInterface) grpc.StreamHandler {
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		name, ok := srv.(protoreflect.FullName)
+		if !ok {
+			method, ok := grpc.Method(ss.Context())
+			if !ok {
+				return status.Error(codes.Internal, "no method in stream context")
+			}
+			name = protoreflect.FullName(strings.ReplaceAll(strings.TrimPrefix(method, "/"), "/", "."))
+		}
+		desc, err := files.FindDescriptorByName(name)
+		if err != nil {
+			return status.Errorf(codes.Unimplemented, "method not found: %s", name)
+		}
+		md, ok := desc.(protoreflect.MethodDescriptor)
+		if !ok {
+			return status.Errorf(codes.Unimplemented, "not a method: %s", name)
+		}
+		return forward(md, conn, ss)
+	}
+}
+
+// forward calls the method md on conn with the requests received on ss and
+// sends the responses back on ss.
+func forward(md protoreflect.MethodDescriptor, conn grpc.ClientConnInterface, ss grpc.ServerStream) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	ctx = metadata.NewOutgoingContext(ctx, outgoingMetadata(incoming))
+
+	streamDesc := &grpc.StreamDesc{
+		StreamName:    string(md.Name()),
+		ServerStreams: md.IsStreamingServer(),
+		ClientStreams: md.IsStreamingClient(),
+	}
+	method := "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+	cs, err := conn.NewStream(ctx, streamDesc, method)
+	if err != nil {
+		return err
+	}
+
+	// Requests are forwarded concurrently with responses so bidirectional
+	// streams can interleave them. A request error cancels the call.
+	reqErr := make(chan error, 1)
+	sendRequests := func() {
+		if err := forwardRequests(md, ss, cs); err != nil {
+			reqErr <- err
+			cancel()
+		}
+	}
+	if md.IsStreamingClient() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sendRequests()
+		}()
+		defer stopRequests(ss, cancel, done)
+	} else {
+		sendRequests()
+	}
+
+	for first := true; ; first = false {
+		resp := dynamicpb.NewMessage(md.Output())
+		err := cs.RecvMsg(resp)
+		if first {
+			if header, err := cs.Header(); err == nil {
+				if err := ss.SetHeader(header); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			ss.SetTrailer(cs.Trailer())
+			select {
+			case err := <-reqErr:
+				return err
+			default:
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := ss.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// recvCanceler is implemented by streams whose pending RecvMsg calls can be
+// unblocked, making them fail.
+type recvCanceler interface {
+	cancelRecv()
+}
+
+// stopRequests cancels the forwarded call and waits for the goroutine
+// forwarding its requests, signalling done, to return so it does not use ss
+// once the call has ended. A request still being received on ss is
+// cancelled if ss is a recvCanceler, as the streams of a [Handler] are.
+// Otherwise the goroutine is left to end with ss: the streams of a
+// grpc.Server fail pending RecvMsg calls once the method handler returns,
+// so waiting for it would deadlock a client waiting for the call status
+// before ending its request stream.
+func stopRequests(ss grpc.ServerStream, cancel context.CancelFunc, done <-chan struct{}) {
+	cancel()
+	select {
+	case <-done:
+		return
+	default:
+	}
+	if rc, ok := ss.(recvCanceler); ok {
+		rc.cancelRecv()
+		<-done
+	}
+}
+
+// forwardRequests sends the requests received on ss to cs. Methods that are
+// not client-streaming receive a single request.
+func forwardRequests(md protoreflect.MethodDescriptor, ss grpc.ServerStream, cs grpc.ClientStream) error {
+	for {
+		req := dynamicpb.NewMessage(md.Input())
+		err := ss.RecvMsg(req)
+		if errors.Is(err, io.EOF) {
+			return cs.CloseSend()
+		}
+		if _, ok := status.FromError(err); !ok {
+			// Requests that cannot be decoded are the caller's fault.
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		// A send error means the call has ended, and the call status is
+		// returned by RecvMsg.
+		if err := cs.SendMsg(req); err != nil {
+			return nil
+		}
+		if !md.IsStreamingClient() {
+			return cs.CloseSend()
+		}
+	}
+}
+
+// outgoingMetadata returns the incoming metadata of a call without the
+// pseudo-headers and transport headers of the incoming call, which the
+// forwarded call sets itself. The deadline of the incoming call is
+// forwarded with its context.
+func outgoingMetadata(incoming metadata.MD) metadata.MD {
+	md := incoming.Copy()
+	for key := range md {
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || key == "content-type" || key == "user-agent" || key == "te" {
+			delete(md, key)
+		}
+	}
+	return md
+}
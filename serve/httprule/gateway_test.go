@@ -0,0 +1,157 @@
+package httprule
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"foxygo.at/jig/serve"
+	"foxygo.at/protog/registry"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newGreetFiles(t *testing.T) *registry.Files {
+	t.Helper()
+	files := new(registry.Files)
+	require.NoError(t, files.RegisterFile(greet.File_greet_greeter_proto))
+	return files
+}
+
+func TestGateway(t *testing.T) {
+	upstream := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger))
+	h, err := NewGateway(newGreetFiles(t), upstream.ClientConn, WithLogger(log.DiscardLogger))
+	require.NoError(t, err)
+	gw := httptest.NewServer(h)
+	defer gw.Close()
+
+	post := func(path, contentType, accept, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", gw.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(raw)
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		resp, body := post("/api/greet/hello", ContentTypeJSON, "", `{"first_name": "Kitty"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello Kitty"}`, body)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		resp, body := post("/api/greet/hello", ContentTypeJSON, "", `{"first_name": "Bart"}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		require.Contains(t, body, "eat my shorts")
+		require.Equal(t, []string{"my", "shorts"}, resp.Header.Values("Grpc-Metadata-Eat"))
+		require.Equal(t, "cow", resp.Header.Get("Grpc-Trailer-A"))
+	})
+
+	t.Run("server stream", func(t *testing.T) {
+		resp, body := post("/api/greet/serverstream", ContentTypeJSON, ContentTypeNDJSON, `{"first_name": "Kitty"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		require.Len(t, lines, 2)
+		require.JSONEq(t, `{"greeting": "💃 jig [server]: Hello Kitty"}`, lines[0])
+		require.JSONEq(t, `{"greeting": "💃 jig [server]: Goodbye Kitty"}`, lines[1])
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		resp, body := post("/api/greet/clientstream", ContentTypeNDJSON, ContentTypeJSON, "{\"first_name\": \"1\"}\n{\"first_name\": \"2\"}\n")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.JSONEq(t, `{"greeting": "💃 jig [client]: Hello 1 and 2"}`, body)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		resp, body := post("/api/greet/hello", ContentTypeJSON, "", `{"first_name": 1}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	})
+}
+
+func TestGatewayClientStreamEarlyError(t *testing.T) {
+	failing := func(_ interface{}, _ grpc.ServerStream) error {
+		return status.Error(codes.FailedPrecondition, "not now")
+	}
+	withHandler := serve.WithMethodHandler("greet.Greeter.HelloClientStream", failing)
+	upstream := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHandler)
+	h, err := NewGateway(newGreetFiles(t), upstream.ClientConn, WithLogger(log.DiscardLogger))
+	require.NoError(t, err)
+	gw := httptest.NewServer(h)
+	defer gw.Close()
+
+	// The request body is never ended, so the call only returns if the
+	// gateway stops reading it when the upstream call fails.
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go bodyWriter.Write([]byte("{\"first_name\": \"1\"}\n")) //nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", gw.URL+"/api/greet/clientstream", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", ContentTypeNDJSON)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, string(raw))
+	require.Contains(t, string(raw), "not now")
+}
+
+func TestForwardingHandlerGRPC(t *testing.T) {
+	var upstreamMD metadata.MD
+	hello := func(_ interface{}, stream grpc.ServerStream) error {
+		upstreamMD, _ = metadata.FromIncomingContext(stream.Context())
+		req := &greet.HelloRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		if req.FirstName == "" {
+			return status.Error(codes.InvalidArgument, "no name")
+		}
+		return stream.SendMsg(&greet.HelloResponse{Greeting: "Hello " + req.FirstName})
+	}
+	upstream := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), serve.WithMethodHandler("greet.Greeter.Hello", hello))
+
+	proxy := grpc.NewServer(grpc.UnknownServiceHandler(ForwardingHandler(newGreetFiles(t), upstream.ClientConn)))
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go proxy.Serve(lis) //nolint: errcheck
+	defer proxy.Stop()
+	cc, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := greet.NewGreeterClient(cc)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-jig-session", "s1")
+	resp, err := client.Hello(ctx, &greet.HelloRequest{FirstName: "Kitty"})
+	require.NoError(t, err)
+	require.Equal(t, "Hello Kitty", resp.Greeting)
+	require.Equal(t, []string{"s1"}, upstreamMD.Get("x-jig-session"))
+
+	_, err = client.Hello(ctx, &greet.HelloRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	err = cc.Invoke(ctx, "/greet.Greeter/Missing", &greet.HelloRequest{}, &greet.HelloResponse{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
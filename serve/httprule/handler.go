@@ -2,36 +2,58 @@ package httprule
 
 import (
 	"context"
-	"fmt"
-	"mime"
+	"errors"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"foxygo.at/jig/log"
+	"foxygo.at/jig/serve"
 	"foxygo.at/protog/registry"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 type httpMethod struct {
-	desc protoreflect.MethodDescriptor
-	rule *annotations.HttpRule
+	desc       protoreflect.MethodDescriptor
+	rule       *annotations.HttpRule
+	httpMethod string
+	tmpl       *pathTemplate
 }
 
 // Handler serves protobuf methods, annotated using httprule options, over HTTP.
 type Handler struct {
 	httpMethods    []*httpMethod
+	router         router
 	grpcHandler    grpc.StreamHandler
 	log            log.Logger
 	ruleTemplates  []*annotations.HttpRule
+	configRules    []*annotations.HttpRule
+	autoRules      bool
 	defaultHandler http.Handler
+	cors           *CORS
+	openAPIPath    string
+	jsonArrays     bool // stream JSON responses as an array
+
+	// incomingHeaders and incomingPrefixes select the HTTP request headers
+	// forwarded as incoming metadata.
+	incomingHeaders  map[string]bool
+	incomingPrefixes []headerPrefix
+	// headerPrefix and trailerPrefix prefix the keys of the header and
+	// trailer metadata of a method in the HTTP response.
+	headerPrefix  string
+	trailerPrefix string
+
+	marshaler marshaler
 }
 
 // NewHandler returns a new [Handler] that implements [http.Handler] that will
@@ -40,8 +62,11 @@ type Handler struct {
 // handler.
 func NewHandler(files *registry.Files, handler grpc.StreamHandler, options ...Option) (*Handler, error) {
 	h := &Handler{
-		grpcHandler:    handler,
-		defaultHandler: http.NotFoundHandler(),
+		grpcHandler:      handler,
+		incomingHeaders:  map[string]bool{},
+		incomingPrefixes: slices.Clone(defaultHeaderPrefixes),
+		headerPrefix:     MetadataHeaderPrefix,
+		trailerPrefix:    MetadataTrailerPrefix,
 	}
 	for _, opt := range options {
 		if err := opt(h); err != nil {
@@ -51,8 +76,15 @@ func NewHandler(files *registry.Files, handler grpc.StreamHandler, options ...Op
 	if h.log == nil {
 		h.log = log.NewLogger(os.Stderr, log.LogLevelError)
 	}
-	h.httpMethods = loadHTTPRules(h.log, files, h.ruleTemplates)
-
+	for _, m := range h.loadHTTPRules(files) {
+		// Like invalid rules, a rule conflicting with an earlier one is
+		// logged and skipped.
+		if err := h.router.add(m); err != nil {
+			h.log.Errorf("ignoring HttpRule for %s: %v", m.desc.FullName(), err)
+			continue
+		}
+		h.httpMethods = append(h.httpMethods, m)
+	}
 	return h, nil
 }
 
@@ -80,8 +112,10 @@ func WithRuleTemplates(httpRuleTemplates []*annotations.HttpRule) Option {
 // WithDefaultHandler is an [Option] to configure a [Handler] with a fallback
 // handler when the request being handled does not match any of the gRPC
 // methods the [Handler] is configured with. By default the [Handler] will
-// return a 404 NotFound response. If a default handler is supplied, it will be
-// called instead of returning that 404 NotFound response.
+// return a 404 NotFound response, or a 405 MethodNotAllowed response if the
+// request path matches a method but its HTTP method does not. If a default
+// handler is supplied, it will be called instead of returning those
+// responses.
 func WithDefaultHandler(next http.Handler) Option {
 	return func(h *Handler) error {
 		h.defaultHandler = next
@@ -89,6 +123,20 @@ func WithDefaultHandler(next http.Handler) Option {
 	}
 }
 
+// WithJSONStreamArrays is an [Option] to configure a [Handler] to stream the
+// responses of server-streaming methods as the elements of a JSON array to
+// all clients getting application/json. Clients naming application/json in
+// their Accept header always get an array, but by default a JSON response
+// to clients without an Accept header or accepting any type is a single
+// message, as for unary methods, and methods sending more than one message
+// fail.
+func WithJSONStreamArrays() Option {
+	return func(h *Handler) error {
+		h.jsonArrays = true
+		return nil
+	}
+}
+
 // Server is a [Handler], and exists for backwards compatibility.
 //
 // Deprecated: Use [Handler] instead.
@@ -103,33 +151,94 @@ func NewServer(files *registry.Files, handler grpc.StreamHandler, l log.Logger,
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for _, method := range h.httpMethods {
-		if vars := MatchRequest(method.rule, r); vars != nil {
-			h.serveHTTPMethod(method, vars, w, r)
+	if h.cors != nil && h.serveCORS(w, r) {
+		return
+	}
+	if h.openAPIPath != "" && r.Method == http.MethodGet && r.URL.Path == h.openAPIPath {
+		h.serveOpenAPI(w)
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		if method, vars := h.matchWebSocket(r); method != nil {
+			h.serveWebSocket(method, vars, w, r)
 			return
 		}
 	}
-	h.defaultHandler.ServeHTTP(w, r)
+	accept := func(m *httpMethod) bool { return m.httpMethod == r.Method }
+	method, vars, allowed := h.router.match(r.URL.EscapedPath(), accept)
+	switch {
+	case method != nil:
+		h.serveHTTPMethod(method, vars, w, r)
+	case h.defaultHandler != nil:
+		h.defaultHandler.ServeHTTP(w, r)
+	case len(allowed) != 0:
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 // Serve a google.api.http annotated method as HTTP
 func (h *Handler) serveHTTPMethod(m *httpMethod, vars map[string]string, w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle streaming calls.
 	ss := &serverStream{
-		req:        r,
-		respWriter: w,
-		rule:       m.rule,
-		vars:       vars,
-		log:        h.log,
+		req:           r,
+		respWriter:    w,
+		rule:          m.rule,
+		vars:          vars,
+		log:           h.log,
+		md:            h.incomingMetadata(r),
+		headerPrefix:  h.headerPrefix,
+		trailerPrefix: h.trailerPrefix,
+		marshaler:     h.marshaler,
+		streaming:     m.desc.IsStreamingServer(),
+		rawReq:        m.rule.Body != "" && isHTTPBody(m.desc.Input(), m.rule.Body),
+		rawResp:       isHTTPBody(m.desc.Output(), m.rule.ResponseBody),
 	}
-	if err := h.grpcHandler(m.desc.FullName(), ss); err != nil {
-		ss.writeError(err)
+	accept, err := getAcceptType(r, ss.streaming, !ss.rawReq)
+	switch {
+	case err == nil:
+		ss.acceptType = accept
+	case ss.rawResp:
+		// Raw responses have their own content type, so the Accept
+		// header only applies to errors.
+		ss.acceptType = ContentTypeJSON
+	default:
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
 		return
 	}
-	ss.writeResp()
+	if ss.streaming && !ss.rawResp && ss.acceptType == ContentTypeJSON && !h.jsonArrays && !acceptsExplicitly(r, ContentTypeJSON) {
+		// Clients getting JSON by default, without asking for it, get a
+		// single JSON message unless JSON arrays are enabled.
+		ss.streaming = false
+	}
+	if m.desc.IsStreamingClient() {
+		ss.reqStream = &requestStream{rule: m.rule, vars: vars, req: r}
+		if m.desc.IsStreamingServer() {
+			// Let bidi streaming methods respond while the request body is
+			// still being read. HTTP/2 is always full duplex.
+			_ = http.NewResponseController(w).EnableFullDuplex()
+		}
+	}
+	err = h.grpcHandler(m.desc.FullName(), ss)
+	switch {
+	case ss.streaming && ss.sent > 0:
+		ss.endStream(err)
+	case err != nil:
+		ss.writeError(err)
+	case ss.streaming:
+		ss.endStream(nil)
+	default:
+		ss.writeResp()
+	}
 }
 
-func loadHTTPRules(l log.Logger, files *registry.Files, httpRuleTemplates []*annotations.HttpRule) []*httpMethod {
+// loadHTTPRules returns the HTTP bindings of the methods in files. The HTTP
+// rules of a method are those of the service config rules selecting it, or
+// failing that its HttpRule annotations, the rule derived from its name if
+// auto rules are enabled, or the rule templates, in that order.
+func (h *Handler) loadHTTPRules(files *registry.Files) []*httpMethod {
+	l := h.log
 	var httpMethods []*httpMethod
 	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
 		sds := fd.Services()
@@ -138,13 +247,28 @@ func loadHTTPRules(l log.Logger, files *registry.Files, httpRuleTemplates []*ann
 			mds := sd.Methods()
 			for j := 0; j < mds.Len(); j++ {
 				md := mds.Get(j)
-				rules := Collect(md)
-				if len(rules) == 0 && len(httpRuleTemplates) != 0 {
-					rules = interpolateHTTPRules(httpRuleTemplates, string(fd.Package()), string(sd.Name()), string(md.Name()))
+				rules := selectRules(h.configRules, md)
+				if len(rules) == 0 {
+					rules = Collect(md)
+				}
+				if len(rules) == 0 && h.autoRules {
+					if rule := autoRule(files, md); rule != nil {
+						rules = []*annotations.HttpRule{rule}
+					}
 				}
+				if len(rules) == 0 && len(h.ruleTemplates) != 0 {
+					rules = interpolateHTTPRules(h.ruleTemplates, string(fd.Package()), string(sd.Name()), string(md.Name()))
+				}
+				rules = expandBindings(l, md.FullName(), rules)
 				l.Debugf("loading %d HTTPRules for %q", len(rules), md.Name())
 				for _, r := range rules {
-					m := &httpMethod{desc: md, rule: r}
+					method, pattern := extractSelect(r)
+					tmpl, err := parseTemplate(pattern)
+					if err != nil {
+						l.Errorf("ignoring HttpRule for %s: %v", md.FullName(), err)
+						continue
+					}
+					m := &httpMethod{desc: md, rule: r, httpMethod: method, tmpl: tmpl}
 					httpMethods = append(httpMethods, m)
 				}
 			}
@@ -154,28 +278,78 @@ func loadHTTPRules(l log.Logger, files *registry.Files, httpRuleTemplates []*ann
 	return httpMethods
 }
 
+// expandBindings returns rules with their additional bindings expanded into
+// rules of their own, so each binding is routed like a top-level rule.
+// Invalid bindings are logged and skipped: additional bindings must have a
+// pattern and must not nest additional bindings themselves.
+func expandBindings(l log.Logger, method protoreflect.FullName, rules []*annotations.HttpRule) []*annotations.HttpRule {
+	var result []*annotations.HttpRule
+	for _, rule := range rules {
+		if err := validateRule(rule); err != nil {
+			l.Errorf("ignoring invalid HttpRule for %s: %v", method, err)
+			continue
+		}
+		bindings := rule.GetAdditionalBindings()
+		if len(bindings) != 0 {
+			rule = proto.Clone(rule).(*annotations.HttpRule)
+			rule.AdditionalBindings = nil
+		}
+		result = append(result, rule)
+		for i, binding := range bindings {
+			if len(binding.GetAdditionalBindings()) != 0 {
+				l.Errorf("ignoring additional binding %d of %s: additional bindings must not be nested", i, method)
+				continue
+			}
+			if err := validateRule(binding); err != nil {
+				l.Errorf("ignoring additional binding %d of %s: %v", i, method, err)
+				continue
+			}
+			result = append(result, binding)
+		}
+	}
+	return result
+}
+
+// validateRule returns an error if rule has no HTTP method or path pattern.
+func validateRule(rule *annotations.HttpRule) error {
+	if rule.GetPattern() == nil {
+		return errors.New("no pattern")
+	}
+	if custom, ok := rule.GetPattern().(*annotations.HttpRule_Custom); ok && custom.Custom.GetKind() == "" {
+		return errors.New("no HTTP method for custom pattern")
+	}
+	return nil
+}
+
 func interpolateHTTPRules(httpRuleTemplates []*annotations.HttpRule, pkg, service, method string) []*annotations.HttpRule {
 	rules := make([]*annotations.HttpRule, len(httpRuleTemplates))
 	for i, tmpl := range httpRuleTemplates {
 		rules[i] = proto.Clone(tmpl).(*annotations.HttpRule)
-		switch v := rules[i].Pattern.(type) {
-		case *annotations.HttpRule_Get:
-			v.Get = interpolate(v.Get, pkg, service, method)
-		case *annotations.HttpRule_Put:
-			v.Put = interpolate(v.Put, pkg, service, method)
-		case *annotations.HttpRule_Post:
-			v.Post = interpolate(v.Post, pkg, service, method)
-		case *annotations.HttpRule_Delete:
-			v.Delete = interpolate(v.Delete, pkg, service, method)
-		case *annotations.HttpRule_Patch:
-			v.Patch = interpolate(v.Patch, pkg, service, method)
-		case *annotations.HttpRule_Custom:
-			v.Custom.Path = interpolate(v.Custom.Path, pkg, service, method)
+		interpolateRule(rules[i], pkg, service, method)
+		for _, binding := range rules[i].AdditionalBindings {
+			interpolateRule(binding, pkg, service, method)
 		}
 	}
 	return rules
 }
 
+func interpolateRule(rule *annotations.HttpRule, pkg, service, method string) {
+	switch v := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		v.Get = interpolate(v.Get, pkg, service, method)
+	case *annotations.HttpRule_Put:
+		v.Put = interpolate(v.Put, pkg, service, method)
+	case *annotations.HttpRule_Post:
+		v.Post = interpolate(v.Post, pkg, service, method)
+	case *annotations.HttpRule_Delete:
+		v.Delete = interpolate(v.Delete, pkg, service, method)
+	case *annotations.HttpRule_Patch:
+		v.Patch = interpolate(v.Patch, pkg, service, method)
+	case *annotations.HttpRule_Custom:
+		v.Custom.Path = interpolate(v.Custom.Path, pkg, service, method)
+	}
+}
+
 func interpolate(path, pkg, service, method string) string {
 	path = strings.ReplaceAll(path, "{package}", pkg)
 	path = strings.ReplaceAll(path, "{service}", service)
@@ -184,8 +358,10 @@ func interpolate(path, pkg, service, method string) string {
 }
 
 type serverStream struct {
+	httpResp   *serve.HTTPResponse
 	header     metadata.MD
 	trailer    metadata.MD
+	md         metadata.MD // incoming metadata from the request headers
 	req        *http.Request
 	respWriter http.ResponseWriter
 	rule       *annotations.HttpRule
@@ -193,6 +369,25 @@ type serverStream struct {
 	acceptType string
 	resp       proto.Message
 	log        log.Logger
+
+	// streaming is set for server-streaming methods, whose responses are
+	// written as they are sent rather than buffered. sent counts them.
+	streaming bool
+	sent      int
+
+	// reqStream is set for client-streaming methods, to decode multiple
+	// request messages from the request body.
+	reqStream *requestStream
+
+	headerPrefix  string
+	trailerPrefix string
+	marshaler     marshaler
+
+	// rawReq and rawResp are set if the request or response body is a
+	// google.api.HttpBody, which is not encoded according to the
+	// Content-Type and Accept headers.
+	rawReq  bool
+	rawResp bool
 }
 
 var _ grpc.ServerStream = &serverStream{}
@@ -218,98 +413,314 @@ func (s *serverStream) SetTrailer(md metadata.MD) {
 	s.trailer = metadata.Join(s.trailer, md)
 }
 
+// HTTPRequest implements serve.HTTPStream.
+func (s *serverStream) HTTPRequest() *serve.HTTPRequest {
+	return newHTTPRequest(s.req, s.vars)
+}
+
+// SetHTTPResponse implements serve.HTTPStream.
+func (s *serverStream) SetHTTPResponse(r *serve.HTTPResponse) {
+	s.httpResp = r
+}
+
+func newHTTPRequest(r *http.Request, vars map[string]string) *serve.HTTPRequest {
+	return &serve.HTTPRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Vars:   vars,
+		Query:  r.URL.Query(),
+	}
+}
+
 func (s *serverStream) Context() context.Context {
-	// TODO: Propagate metadata to headers.
-	return s.req.Context()
+	return metadata.NewIncomingContext(s.req.Context(), s.md)
 }
 
 func (s *serverStream) SendMsg(m interface{}) error {
-	// Message is buffered until the RPC returns since we don't support client streaming... yet.
+	if s.streaming {
+		return s.writeStreamMsg(m.(proto.Message))
+	}
+	// A unary response is buffered until the RPC returns.
 	if s.resp != nil {
-		panic("only one response expected!")
+		return status.Error(codes.Internal, "only one response expected")
 	}
 	s.resp = m.(proto.Message)
 	return nil
 }
 
-func (s *serverStream) RecvMsg(m interface{}) error {
-	var err error
-	s.acceptType, err = getAcceptType(s.req)
-	if err != nil {
-		return err
+// cancelRecv unblocks a pending RecvMsg reading the request body by
+// expiring its read deadline.
+func (s *serverStream) cancelRecv() {
+	if err := http.NewResponseController(s.respWriter).SetReadDeadline(time.Now()); err != nil {
+		s.log.Debugf("cannot cancel reading request: %v", err)
 	}
+}
 
-	pb := m.(*dynamicpb.Message)
-	return DecodeRequest(s.rule, s.vars, s.req, pb)
+func (s *serverStream) RecvMsg(m interface{}) error {
+	if s.reqStream != nil {
+		return s.reqStream.next(m.(proto.Message))
+	}
+	return DecodeRequest(s.rule, s.vars, s.req, m.(proto.Message))
 }
 
 func (s *serverStream) writeResp() {
-	// TODO: forward headers and trailers.
-	msg, err := marshalerForContentType(s.acceptType)(s.resp)
+	if s.httpResp != nil && s.httpResp.Body != nil {
+		s.writeBody(http.StatusOK, []byte(*s.httpResp.Body))
+		return
+	}
+	if s.resp == nil {
+		s.writeError(status.Error(codes.Internal, "method returned no response"))
+		return
+	}
+	if hb := httpBodyResponse(s.rule.ResponseBody, s.resp); hb != nil {
+		contentType, data := getHTTPBody(hb)
+		s.setContentType(contentType)
+		s.writeBody(http.StatusOK, data)
+		return
+	}
+	msg, err := s.marshaler.marshalResponse(s.rule.ResponseBody, s.acceptType, s.resp)
 	if err != nil {
 		s.writeError(err)
 		return
 	}
-	if _, err = s.respWriter.Write(msg); err != nil {
-		s.log.Errorf("failed to write response")
+	s.setContentType(s.acceptType)
+	s.writeBody(http.StatusOK, msg)
+}
+
+// writeBody writes a complete response with the given status code, unless
+// overridden by the method, and body.
+func (s *serverStream) writeBody(code int, body []byte) {
+	if code = s.writeHeader(code); bodyAllowed(code) {
+		if _, err := s.respWriter.Write(body); err != nil {
+			s.log.Errorf("failed to write response: %v", err)
+		}
+	}
+	s.writeTrailer()
+}
+
+// setContentType sets the Content-Type of the response, if not empty.
+func (s *serverStream) setContentType(contentType string) {
+	if contentType != "" {
+		s.respWriter.Header().Set("Content-Type", contentType)
+	}
+}
+
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// writeHeader writes the HTTP response header with the header metadata of
+// the method. The trailer metadata is written as HTTP trailers if the
+// client accepts them. Otherwise it is added to the header of unary
+// responses and dropped for streamed responses, as it is not known yet.
+// The HTTP status and headers set by the method override code and the
+// headers of the transcoder. writeHeader returns the status code written.
+func (s *serverStream) writeHeader(code int) int {
+	h := s.respWriter.Header()
+	writeMetadata(h, s.header, s.headerPrefix)
+	if !s.streaming {
+		if !acceptsTrailers(s.req) {
+			writeMetadata(h, s.trailer, s.trailerPrefix)
+		} else {
+			// Declare the trailers so the response is not sent with a
+			// Content-Length, which would leave no room for trailers.
+			for key := range s.trailer {
+				h.Add("Trailer", s.trailerPrefix+key)
+			}
+		}
+	}
+	if s.httpResp != nil {
+		for key, values := range s.httpResp.Header {
+			h[key] = values
+		}
+		if s.httpResp.Status != 0 {
+			code = s.httpResp.Status
+		}
+	}
+	s.respWriter.WriteHeader(code)
+	return code
+}
+
+// writeTrailer writes the trailer metadata of the method as HTTP trailers
+// if the client accepts them.
+func (s *serverStream) writeTrailer() {
+	if len(s.trailer) == 0 || !acceptsTrailers(s.req) {
 		return
 	}
+	trailer := http.Header{}
+	writeMetadata(trailer, s.trailer, s.trailerPrefix)
+	h := s.respWriter.Header()
+	for key, values := range trailer {
+		h[http.TrailerPrefix+key] = values
+	}
 }
 
 func (s *serverStream) writeError(err error) {
 	// Fallback message if error marshalling fails.
 	const errMarshalFailed = `{"code": 13, "message": "failed to marshal error message"}`
 
-	w := s.respWriter
 	st := status.Convert(err)
-	// If we don't understand the "Accept" header, error back in JSON without setting Content-Type.
-	marshaler := protojson.Marshal
-	if s.acceptType != "" {
-		marshaler = marshalerForContentType(s.acceptType)
-		w.Header().Set("Content-Type", s.acceptType)
+	contentType := s.acceptType
+	if contentType == ContentTypeNDJSON || contentType == ContentTypeEventStream {
+		// Errors before any streamed response are not framed.
+		contentType = ContentTypeJSON
 	}
+	s.respWriter.Header().Set("Content-Type", contentType)
 
-	buf, err := marshaler(st.Proto())
+	if s.httpResp != nil && s.httpResp.Body != nil {
+		s.writeBody(HTTPStatusFromCode(st.Code()), []byte(*s.httpResp.Body))
+		return
+	}
+	buf, err := s.marshaler.marshal(contentType, st.Proto())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err = w.Write([]byte(errMarshalFailed)); err != nil {
-			s.log.Errorf("failed to write error response: %+v", err)
-		}
+		s.writeBody(http.StatusInternalServerError, []byte(errMarshalFailed))
 		return
 	}
-	s.respWriter.WriteHeader(HTTPStatusFromCode(st.Code()))
-	if _, err = s.respWriter.Write(buf); err != nil {
-		s.log.Errorf("failed to write error response: %+v", err)
+	s.writeBody(HTTPStatusFromCode(st.Code()), buf)
+}
+
+// writeStreamMsg writes a response message of a server-streaming method,
+// framed according to the accept type, and flushes it to the client:
+//
+//   - application/json: the messages are elements of a JSON array, if
+//     enabled with [WithJSONStreamArrays].
+//   - application/x-ndjson: one message per line (newline-delimited JSON).
+//   - text/event-stream: one message per server-sent event.
+//   - application/x-protobuf: varint length-delimited binary messages.
+//   - application/yaml: one YAML document per message.
+func (s *serverStream) writeStreamMsg(m proto.Message) error {
+	if s.rawResp {
+		return s.writeRawStreamMsg(m)
 	}
+	w := s.respWriter
+	if s.sent == 0 {
+		s.startStream()
+	}
+	b, err := s.marshaler.marshalResponse(s.rule.ResponseBody, s.acceptType, m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot marshal response: %v", err)
+	}
+	if s.acceptType == ContentTypeBinaryProto {
+		_, err = w.Write(append(protowire.AppendVarint(nil, uint64(len(b))), b...))
+	} else {
+		err = s.writeFrame(b, "")
+	}
+	if err != nil {
+		return err
+	}
+	s.sent++
+	if err := http.NewResponseController(w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
 }
 
-func getAcceptType(r *http.Request) (string, error) {
-	var err error
-	mediaType := ContentTypeJSON
-	// TODO: There's a lot more to parsing Accept headers...
-	accept := r.Header.Get("Accept")
-	if accept == "" {
-		accept = r.Header.Get("Content-Type")
+// writeRawStreamMsg writes the data of a google.api.HttpBody response of a
+// server-streaming method. The content type of the first response is the
+// Content-Type of the HTTP response.
+func (s *serverStream) writeRawStreamMsg(m proto.Message) error {
+	hb := httpBodyResponse(s.rule.ResponseBody, m)
+	contentType, data := getHTTPBody(hb)
+	if s.sent == 0 {
+		s.setContentType(contentType)
+		s.writeHeader(http.StatusOK)
 	}
-	if accept != "" && accept != "*/*" {
-		mediaType, _, err = mime.ParseMediaType(accept)
+	if _, err := s.respWriter.Write(data); err != nil {
+		return err
+	}
+	s.sent++
+	if err := http.NewResponseController(s.respWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (s *serverStream) startStream() {
+	s.respWriter.Header().Set("Content-Type", s.acceptType)
+	s.writeHeader(http.StatusOK)
+	if s.acceptType == ContentTypeJSON {
+		s.write([]byte("["))
+	}
+}
+
+// writeFrame writes a JSON or YAML message of a server-stream. event names the
+// server-sent event, if not the default "message" event.
+func (s *serverStream) writeFrame(b []byte, event string) error {
+	var frame []byte
+	switch s.acceptType {
+	case ContentTypeJSON:
+		if s.sent > 0 {
+			frame = append(frame, ',')
+		}
+		frame = append(frame, b...)
+	case ContentTypeNDJSON:
+		frame = append(b, '\n')
+	case ContentTypeEventStream:
+		if event != "" {
+			frame = append(frame, "event: "+event+"\n"...)
+		}
+		frame = append(frame, "data: "...)
+		frame = append(frame, b...)
+		frame = append(frame, "\n\n"...)
+	case ContentTypeYAML:
+		frame = append([]byte("---\n"), b...)
+	}
+	_, err := s.respWriter.Write(frame)
+	return err
+}
+
+// endStream terminates the response of a server-streaming method. An error
+// after responses have been streamed can no longer change the HTTP status,
+// so it is written as a final frame: an {"error": status} object for JSON
+// and YAML framings, and an "error" event for server-sent events. Binary
+// streams are aborted.
+func (s *serverStream) endStream(err error) {
+	if s.rawResp {
 		if err != nil {
-			return "", err
+			// Raw streams have no framing to report errors with.
+			panic(http.ErrAbortHandler)
+		}
+		if s.sent == 0 {
+			s.writeHeader(http.StatusOK)
+		}
+		s.writeTrailer()
+		return
+	}
+	if s.sent == 0 {
+		s.startStream()
+	}
+	if err != nil {
+		if s.acceptType == ContentTypeBinaryProto {
+			panic(http.ErrAbortHandler)
+		}
+		st, merr := protojson.Marshal(status.Convert(err).Proto())
+		if merr != nil {
+			s.log.Errorf("failed to marshal stream error: %v", merr)
+			return
+		}
+		frame := st
+		if s.acceptType != ContentTypeEventStream {
+			frame = []byte(`{"error":` + string(st) + `}`)
+		}
+		if s.acceptType == ContentTypeYAML {
+			if frame, merr = jsonToYAML(frame); merr != nil {
+				s.log.Errorf("failed to marshal stream error: %v", merr)
+				return
+			}
+		}
+		if werr := s.writeFrame(frame, "error"); werr != nil {
+			s.log.Errorf("failed to write stream error: %v", werr)
+			return
 		}
 	}
-	if mediaType != ContentTypeBinaryProto && mediaType != ContentTypeJSON {
-		return "", fmt.Errorf("invalid Accept content type %s", accept)
+	if s.acceptType == ContentTypeJSON {
+		s.write([]byte("]"))
 	}
-	return mediaType, nil
+	s.writeTrailer()
 }
 
-func marshalerForContentType(mediaType string) func(m proto.Message) ([]byte, error) {
-	switch mediaType {
-	case ContentTypeBinaryProto:
-		return proto.Marshal
-	case ContentTypeJSON:
-		return protojson.Marshal
-	default:
-		panic("invalid content type")
+func (s *serverStream) write(b []byte) {
+	if _, err := s.respWriter.Write(b); err != nil {
+		s.log.Errorf("failed to write response: %v", err)
 	}
 }
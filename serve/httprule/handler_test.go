@@ -1,6 +1,10 @@
 package httprule
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,10 +16,18 @@ import (
 	"foxygo.at/jig/pb/greet"
 	"foxygo.at/jig/serve"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
 )
 
 func TestHTTP(t *testing.T) {
@@ -83,13 +95,22 @@ func TestHTTP(t *testing.T) {
 	})
 
 	t.Run("return 404 for invalid path", func(t *testing.T) {
+		req, err := http.NewRequest("POST", url+"/invalid", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("return 405 for invalid method", func(t *testing.T) {
 		// GET is not handled
 		req, err := http.NewRequest("GET", url, nil)
 		require.NoError(t, err)
 		req.Header.Set("Accept", "application/json; charset=utf-8")
 		resp, err := http.DefaultClient.Do(req)
 		require.NoError(t, err)
-		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		require.Equal(t, "POST", resp.Header.Get("Allow"))
 	})
 
 	teapot := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -109,6 +130,397 @@ func TestHTTP(t *testing.T) {
 	})
 }
 
+func TestHTTPServerStream(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	arrays := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(WithJSONStreamArrays()))
+	single := serve.WithMethodHandler("greet.Greeter.HelloServerStream", func(_ interface{}, ss grpc.ServerStream) error {
+		if err := ss.RecvMsg(&greet.HelloRequest{}); err != nil {
+			return err
+		}
+		return ss.SendMsg(&greet.HelloResponse{Greeting: "only"})
+	})
+	singleTS := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), single, withHTTPRuleHandler())
+	postTo := func(ts *serve.TestServer, accept, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://jig/api/greet/serverstream", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(raw)
+	}
+	post := func(accept, body string) (*http.Response, string) {
+		t.Helper()
+		return postTo(ts, accept, body)
+	}
+	hello := `{"greeting":"💃 jig [server]: Hello Stranger"}`
+	goodbye := `{"greeting":"💃 jig [server]: Goodbye Stranger"}`
+
+	t.Run("JSON single message", func(t *testing.T) {
+		resp, body := postTo(singleTS, "", `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+		require.JSONEq(t, `{"greeting": "only"}`, body)
+	})
+
+	t.Run("JSON multiple messages", func(t *testing.T) {
+		resp, body := post("*/*", `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.JSONEq(t, `{"code": 13, "message": "only one response expected"}`, body)
+	})
+
+	t.Run("JSON array", func(t *testing.T) {
+		resp, body := postTo(arrays, "", `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+		require.JSONEq(t, "["+hello+","+goodbye+"]", body)
+	})
+
+	t.Run("JSON array accepted explicitly", func(t *testing.T) {
+		resp, body := post(ContentTypeJSON, `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+		require.JSONEq(t, "["+hello+","+goodbye+"]", body)
+	})
+
+	t.Run("newline-delimited JSON", func(t *testing.T) {
+		resp, body := post(ContentTypeNDJSON, `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeNDJSON, resp.Header.Get("Content-Type"))
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		require.Len(t, lines, 2)
+		require.JSONEq(t, hello, lines[0])
+		require.JSONEq(t, goodbye, lines[1])
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		resp, body := post(ContentTypeEventStream, `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeEventStream, resp.Header.Get("Content-Type"))
+		events := strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+		require.Len(t, events, 2)
+		require.JSONEq(t, hello, strings.TrimPrefix(events[0], "data: "))
+		require.JSONEq(t, goodbye, strings.TrimPrefix(events[1], "data: "))
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		resp, body := post(ContentTypeBinaryProto, `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		r := bufio.NewReader(strings.NewReader(body))
+		var greetings []string
+		for {
+			msg := &greet.HelloResponse{}
+			err := protodelim.UnmarshalFrom(r, msg)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			greetings = append(greetings, msg.Greeting)
+		}
+		require.Equal(t, []string{"💃 jig [server]: Hello Stranger", "💃 jig [server]: Goodbye Stranger"}, greetings)
+	})
+
+	t.Run("error before stream", func(t *testing.T) {
+		resp, body := post(ContentTypeNDJSON, `{"first_name": "Bart"}`)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+		require.JSONEq(t, `{"code": 3, "message": "💃 jig [server]: eat my shorts"}`, body)
+	})
+
+	t.Run("unary method rejects stream framing", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://jig/api/greet/hello", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		req.Header.Set("Accept", ContentTypeNDJSON)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	})
+}
+
+func TestHTTPContentNegotiation(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	post := func(path, contentType, accept, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://jig"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(raw)
+	}
+
+	t.Run("YAML", func(t *testing.T) {
+		resp, body := post("/api/greet/hello", ContentTypeYAML, "", "first_name: Stranger\n")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeYAML, resp.Header.Get("Content-Type"))
+		var got map[string]string
+		require.NoError(t, yaml.Unmarshal([]byte(body), &got))
+		require.Equal(t, map[string]string{"greeting": "💃 jig [unary]: Hello Stranger"}, got)
+	})
+
+	t.Run("text format", func(t *testing.T) {
+		resp, body := post("/api/greet/hello", ContentTypeJSON, "application/xml, text/*;q=0.5", `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeTextProto, resp.Header.Get("Content-Type"))
+		got := &greet.HelloResponse{}
+		require.NoError(t, prototext.Unmarshal([]byte(body), got))
+		require.Equal(t, "💃 jig [unary]: Hello Stranger", got.Greeting)
+	})
+
+	t.Run("YAML stream", func(t *testing.T) {
+		resp, body := post("/api/greet/serverstream", ContentTypeJSON, ContentTypeYAML, `{"first_name": "Stranger"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ContentTypeYAML, resp.Header.Get("Content-Type"))
+		dec := yaml.NewDecoder(strings.NewReader(body))
+		var greetings []string
+		for {
+			var got map[string]string
+			err := dec.Decode(&got)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			greetings = append(greetings, got["greeting"])
+		}
+		require.Equal(t, []string{"💃 jig [server]: Hello Stranger", "💃 jig [server]: Goodbye Stranger"}, greetings)
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		resp, _ := post("/api/greet/hello", ContentTypeJSON, "application/xml, application/json;q=0", `{}`)
+		require.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	})
+
+	t.Run("proto JSON options", func(t *testing.T) {
+		opts := WithProtoJSONOptions(protojson.MarshalOptions{EmitUnpopulated: true})
+		ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(opts))
+		req, err := http.NewRequest("POST", "http://jig/api/greet/hello", strings.NewReader(`{"first_name": "Bart"}`))
+		require.NoError(t, err)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Contains(t, string(raw), `"details"`)
+	})
+}
+
+func TestHTTPServerStreamError(t *testing.T) {
+	failing := func(_ interface{}, ss grpc.ServerStream) error {
+		if err := ss.RecvMsg(&greet.HelloRequest{}); err != nil {
+			return err
+		}
+		if err := ss.SendMsg(&greet.HelloResponse{Greeting: "first"}); err != nil {
+			return err
+		}
+		return status.Error(codes.Aborted, "second")
+	}
+	withHandler := serve.WithMethodHandler("greet.Greeter.HelloServerStream", failing)
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHandler, withHTTPRuleHandler(WithJSONStreamArrays()))
+
+	tests := map[string]string{
+		ContentTypeJSON:        `[{"greeting":"first"},{"error":{"code":10,"message":"second"}}]`,
+		ContentTypeNDJSON:      `{"greeting":"first"}` + "\n" + `{"error":{"code":10,"message":"second"}}` + "\n",
+		ContentTypeEventStream: "data:{\"greeting\":\"first\"}\n\nevent:error\ndata:{\"code\":10,\"message\":\"second\"}\n\n",
+	}
+	for accept, want := range tests {
+		t.Run(accept, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://jig/api/greet/serverstream", strings.NewReader(`{}`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", ContentTypeJSON)
+			req.Header.Set("Accept", accept)
+			resp, err := ts.HTTPClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			raw, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			// protojson output is not stable, so normalise it.
+			got := strings.ReplaceAll(string(raw), " ", "")
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestHTTPClientStream(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	post := func(contentType string, body []byte) string {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://jig/api/greet/clientstream", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+		return string(raw)
+	}
+
+	t.Run("newline-delimited JSON", func(t *testing.T) {
+		body := "{\"first_name\": \"1\"}\n\n{\"first_name\": \"2\"}\n{\"first_name\": \"3\"}"
+		got := post(ContentTypeNDJSON, []byte(body))
+		require.JSONEq(t, `{"greeting": "💃 jig [client]: Hello 1 and 2 and 3"}`, got)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		var body bytes.Buffer
+		for _, name := range []string{"a", "b"} {
+			_, err := protodelim.MarshalTo(&body, &greet.HelloRequest{FirstName: name})
+			require.NoError(t, err)
+		}
+		req, err := http.NewRequest("POST", "http://jig/api/greet/clientstream", &body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", ContentTypeBinaryProto)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		got := &greet.HelloResponse{}
+		require.NoError(t, proto.Unmarshal(raw, got))
+		require.Equal(t, "💃 jig [client]: Hello a and b", got.Greeting)
+	})
+
+	t.Run("single JSON message", func(t *testing.T) {
+		got := post(ContentTypeJSON, []byte(`{"first_name": "1"}`))
+		require.JSONEq(t, `{"greeting": "💃 jig [client]: Hello 1"}`, got)
+	})
+}
+
+func TestHTTPBidiStream(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	body := "{\"first_name\": \"a\"}\n{\"first_name\": \"b\"}\n"
+	req, err := http.NewRequest("POST", "http://jig/api/greet/bidistream", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", ContentTypeNDJSON)
+	resp, err := ts.HTTPClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ContentTypeNDJSON, resp.Header.Get("Content-Type"))
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.JSONEq(t, `{"greeting": "💃 jig [bidi]: Hello a"}`, lines[0])
+	require.JSONEq(t, `{"greeting": "💃 jig [bidi]: Hello b"}`, lines[1])
+}
+
+func TestWebSocketBidiStream(t *testing.T) {
+	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger))
+	h, err := NewHandler(ts.Files, ts.UnknownHandler, WithLogger(log.DiscardLogger))
+	require.NoError(t, err)
+	ts.SetHTTPHandler(h)
+	ts.Start()
+	defer ts.Stop()
+
+	ws, err := websocket.Dial("ws://"+ts.Addr()+"/api/greet/bidistream", "", "http://"+ts.Addr())
+	require.NoError(t, err)
+	defer ws.Close()
+
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, websocket.Message.Send(ws, `{"firstName": "`+name+`"}`))
+		var msg string
+		require.NoError(t, websocket.Message.Receive(ws, &msg))
+		require.JSONEq(t, `{"greeting": "💃 jig [bidi]: Hello `+name+`"}`, msg)
+	}
+
+	// Binary request messages are accepted too.
+	b, err := proto.Marshal(&greet.HelloRequest{FirstName: "c"})
+	require.NoError(t, err)
+	require.NoError(t, websocket.Message.Send(ws, b))
+	var msg string
+	require.NoError(t, websocket.Message.Receive(ws, &msg))
+	require.JSONEq(t, `{"greeting": "💃 jig [bidi]: Hello c"}`, msg)
+
+	require.NoError(t, websocket.Message.Send(ws, `{"firstName": "Bart"}`))
+	require.NoError(t, websocket.Message.Receive(ws, &msg))
+	require.JSONEq(t, `{"error": {"code": 3, "message": "💃 jig [bidi]: eat my shorts"}}`, msg)
+	require.ErrorIs(t, websocket.Message.Receive(ws, &msg), io.EOF)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger))
+	h, err := NewHandler(ts.Files, ts.UnknownHandler, WithLogger(log.DiscardLogger))
+	require.NoError(t, err)
+	withCORS, err := NewHandler(ts.Files, ts.UnknownHandler, WithLogger(log.DiscardLogger), WithCORS(CORS{AllowedOrigins: []string{"https://*.example.com"}}))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/api/", h)
+	mux.Handle("/cors/", http.StripPrefix("/cors", withCORS))
+	ts.SetHTTPHandler(mux)
+	ts.Start()
+	defer ts.Stop()
+
+	tests := map[string]struct {
+		path    string
+		origin  string
+		allowed bool
+	}{
+		"same origin":             {"/api/greet/bidistream", "http://" + ts.Addr(), true},
+		"cross origin":            {"/api/greet/bidistream", "https://evil.example.com", false},
+		"allowed cross origin":    {"/cors/api/greet/bidistream", "https://app.example.com", true},
+		"disallowed cross origin": {"/cors/api/greet/bidistream", "https://evil.example.org", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ws, err := websocket.Dial("ws://"+ts.Addr()+tc.path, "", tc.origin)
+			if !tc.allowed {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer ws.Close()
+			require.NoError(t, websocket.Message.Send(ws, `{"firstName": "a"}`))
+			var msg string
+			require.NoError(t, websocket.Message.Receive(ws, &msg))
+			require.JSONEq(t, `{"greeting": "💃 jig [bidi]: Hello a"}`, msg)
+		})
+	}
+}
+
+func withHTTPRuleHandler(options ...Option) serve.Option {
+	return serve.WithHTTPHandler(func(s *serve.Server) (http.Handler, error) {
+		return NewHandler(s.Files, s.UnknownHandler, append([]Option{WithLogger(log.DiscardLogger)}, options...)...)
+	})
+}
+
+func TestHTTPMethodHandler(t *testing.T) {
+	hello := func(_ context.Context, req *greet.HelloRequest) (*greet.HelloResponse, error) {
+		return &greet.HelloResponse{Greeting: "👷 go: Hello " + req.FirstName}, nil
+	}
+	withHandler := serve.WithMethodHandler("greet.Greeter.Hello", serve.UnaryHandler(hello))
+	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHandler)
+	h, err := NewHandler(ts.Files, ts.UnknownHandler, WithLogger(log.DiscardLogger))
+	require.NoError(t, err)
+	ts.SetHTTPHandler(h)
+	ts.Start()
+	defer ts.Stop()
+
+	url := fmt.Sprintf("http://%s/api/greet/hello", ts.Addr())
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"first_name": "Stranger"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"greeting": "👷 go: Hello Stranger"}`, string(raw))
+}
+
 func TestHTTPRuleInterpolation(t *testing.T) {
 	logger := log.NewLogger(io.Discard, log.LogLevelError)
 	withLogger := serve.WithLogger(logger)
@@ -150,3 +562,314 @@ func TestHTTPRuleInterpolation(t *testing.T) {
 	expected = `{"greeting": "Simply, hello, fox"}`
 	require.JSONEq(t, expected, string(raw))
 }
+
+func TestHTTPQueryParamError(t *testing.T) {
+	tmpl := []*annotations.HttpRule{{Pattern: &annotations.HttpRule_Get{Get: "/v1/{method}"}}}
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/library"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(WithRuleTemplates(tmpl)))
+
+	resp, err := ts.HTTPClient.Get("http://jig/v1/ListBooks?pageSize=many")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	respPb := &statuspb.Status{}
+	require.NoError(t, protojson.Unmarshal(raw, respPb))
+	require.Equal(t, int32(codes.InvalidArgument), respPb.Code)
+	require.Contains(t, respPb.Message, "query parameter pageSize")
+}
+
+func TestHTTPRuleConflict(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.NewLogger(&logs, log.LogLevelError)
+	ts := serve.NewUnstartedTestServer(serve.JsonnetEvaluator(), os.DirFS("testdata/httpgreet"), serve.WithLogger(logger))
+	tmpl := []*annotations.HttpRule{
+		{Pattern: &annotations.HttpRule_Get{Get: "/get/{method}"}},
+		{Pattern: &annotations.HttpRule_Get{Get: "/get/{method}"}, ResponseBody: "greeting"},
+	}
+	h, err := NewHandler(ts.Files, ts.UnknownHandler, WithLogger(logger), WithRuleTemplates(tmpl))
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "ignoring HttpRule for httpgreet.HttpGreeter.SimpleHello: conflicting HttpRules: GET /get/SimpleHello of httpgreet.HttpGreeter.SimpleHello and GET /get/SimpleHello of httpgreet.HttpGreeter.SimpleHello")
+
+	// The earlier rule is still served.
+	ts.SetHTTPHandler(h)
+	ts.Start()
+	defer ts.Stop()
+	resp, err := http.Get("http://" + ts.Addr() + "/get/SimpleHello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"greeting": "Simply, hello, "}`, string(raw))
+}
+
+func TestHTTPRuleAdditionalBindings(t *testing.T) {
+	tmpl := []*annotations.HttpRule{{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/{method}/{first_name}"},
+		AdditionalBindings: []*annotations.HttpRule{
+			{Pattern: &annotations.HttpRule_Post{Post: "/v1/{method}"}, Body: "*"},
+			{Pattern: &annotations.HttpRule_Get{Get: "/v2/{method}/{first_name}"}},
+		},
+	}}
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/httpgreet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(WithRuleTemplates(tmpl)))
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := ts.HTTPClient.Get("http://jig" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+		return string(raw)
+	}
+	require.JSONEq(t, `{"greeting": "Simply, hello, a"}`, get("/v1/SimpleHello/a"))
+	require.JSONEq(t, `{"greeting": "Simply, hello, b"}`, get("/v2/SimpleHello/b"))
+
+	resp, err := ts.HTTPClient.Post("http://jig/v1/SimpleHello", ContentTypeJSON, strings.NewReader(`{"first_name": "c"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"greeting": "Simply, hello, c"}`, string(raw))
+}
+
+func TestExpandBindings(t *testing.T) {
+	get := func(path string) *annotations.HttpRule {
+		return &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: path}}
+	}
+	rule := get("/a")
+	rule.AdditionalBindings = []*annotations.HttpRule{
+		get("/b"),
+		{AdditionalBindings: []*annotations.HttpRule{get("/nested")}},
+		{},
+		{Pattern: &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{Path: "/no-kind"}}},
+		get("/c"),
+	}
+	var logs bytes.Buffer
+	l := log.NewLogger(&logs, log.LogLevelError)
+	rules := expandBindings(l, "pkg.Service.Method", []*annotations.HttpRule{rule, {}})
+
+	var paths []string
+	for _, r := range rules {
+		require.Empty(t, r.AdditionalBindings)
+		_, path := extractSelect(r)
+		paths = append(paths, path)
+	}
+	require.Equal(t, []string{"/a", "/b", "/c"}, paths)
+	require.Len(t, rule.AdditionalBindings, 5, "original rule must not be modified")
+	require.Contains(t, logs.String(), "additional binding 1 of pkg.Service.Method: additional bindings must not be nested")
+	require.Contains(t, logs.String(), "additional binding 2 of pkg.Service.Method: no pattern")
+	require.Contains(t, logs.String(), "additional binding 3 of pkg.Service.Method: no HTTP method for custom pattern")
+	require.Contains(t, logs.String(), "invalid HttpRule for pkg.Service.Method: no pattern")
+}
+
+func TestHTTPMetadata(t *testing.T) {
+	hello := func(_ interface{}, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		req := &greet.HelloRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		if err := stream.SetHeader(metadata.Pairs("session", md.Get("x-jig-session")[0], "echo-bin", "\x00\x01")); err != nil {
+			return err
+		}
+		stream.SetTrailer(metadata.Pairs("checksum", "abc"))
+		greeting := fmt.Sprintf("Hello %s from %s %s", req.FirstName, md.Get("user-agent"), md.Get("custom"))
+		return stream.SendMsg(&greet.HelloResponse{Greeting: greeting})
+	}
+	withHandler := serve.WithMethodHandler("greet.Greeter.Hello", hello)
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHandler,
+		withHTTPRuleHandler(WithIncomingHeaders("User-Agent"), WithIncomingHeaderPrefix("X-Custom-", "")))
+
+	post := func(header http.Header) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "http://jig/api/greet/hello", strings.NewReader(`{"first_name": "Kitty"}`))
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(raw))
+		return resp, string(raw)
+	}
+
+	header := http.Header{
+		"Content-Type":         {"application/json"},
+		"User-Agent":           {"test"},
+		"X-Custom-Thing":       {"ignored"},
+		"X-Jig-Session":        {"s1"},
+		"Grpc-Metadata-Custom": {"value"},
+		"Other":                {"ignored"},
+	}
+	resp, body := post(header)
+	require.JSONEq(t, `{"greeting": "Hello Kitty from [test] [value]"}`, body)
+	require.Equal(t, "s1", resp.Header.Get("Grpc-Metadata-Session"))
+	require.Equal(t, "AAE=", resp.Header.Get("Grpc-Metadata-Echo-Bin"))
+	// Without "TE: trailers", trailer metadata is sent in the header.
+	require.Equal(t, "abc", resp.Header.Get("Grpc-Trailer-Checksum"))
+	require.Empty(t, resp.Trailer)
+
+	header.Set("TE", "trailers")
+	resp, _ = post(header)
+	require.Empty(t, resp.Header.Get("Grpc-Trailer-Checksum"))
+	require.Equal(t, "abc", resp.Trailer.Get("Grpc-Trailer-Checksum"))
+}
+
+func TestHTTPMetadataError(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger),
+		withHTTPRuleHandler(WithOutgoingHeaderPrefix("", "")))
+	resp, err := ts.HTTPClient.Post("http://jig/api/greet/hello", ContentTypeJSON, strings.NewReader(`{"first_name": "Bart"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, []string{"my", "shorts"}, resp.Header.Values("Eat"))
+	require.Equal(t, "have", resp.Header.Get("Dont"))
+	require.Equal(t, "cow", resp.Header.Get("A"))
+}
+
+func TestHTTPMethodOutput(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/greet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	httpClient := *ts.HTTPClient
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	do := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://jig"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", ContentTypeJSON)
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(raw)
+	}
+
+	ts.Overrides.Set("", "greet.Greeter.Hello", `function(input) {
+		response: {
+			greeting: 'Hello %(firstName)s via %(method)s %(path)s?lang=%(lang)s' % {
+				firstName: input.request.firstName,
+				method: input.http.method,
+				path: input.http.path,
+				lang: input.http.query.lang[0],
+			},
+		},
+		http: {
+			status: 201,
+			headers: { Location: '/greetings/1', 'X-Multi': ['a', 'b'] },
+		},
+	}`)
+	resp, body := do("POST", "/api/greet/hello?lang=en", `{"first_name": "Kitty"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/greetings/1", resp.Header.Get("Location"))
+	require.Equal(t, []string{"a", "b"}, resp.Header.Values("X-Multi"))
+	require.JSONEq(t, `{"greeting": "Hello Kitty via POST /api/greet/hello?lang=en"}`, body)
+
+	// gRPC callers have no http input, and ignore the http output.
+	client := greet.NewGreeterClient(ts.ClientConn)
+	gresp, err := client.Hello(context.Background(), &greet.HelloRequest{FirstName: "Kitty"})
+	require.ErrorContains(t, err, "Field does not exist: http")
+	require.Nil(t, gresp)
+
+	ts.Overrides.Set("", "greet.Greeter.Hello", `function(input) {
+		response: { greeting: 'Hello ' + input.request.firstName },
+		http: { status: 202 },
+	}`)
+	gresp, err = client.Hello(context.Background(), &greet.HelloRequest{FirstName: "Kitty"})
+	require.NoError(t, err)
+	require.Equal(t, "Hello Kitty", gresp.Greeting)
+
+	ts.Overrides.Set("", "greet.Greeter.Hello", `function(input) {
+		http: { status: 204, body: '' },
+	}`)
+	resp, body = do("POST", "/api/greet/hello", `{}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Empty(t, body)
+	_, err = client.Hello(context.Background(), &greet.HelloRequest{})
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	ts.Overrides.Set("", "greet.Greeter.Hello", `function(input) {
+		http: {
+			status: 302,
+			headers: { Location: 'https://example.com', 'Content-Type': 'text/plain' },
+			body: 'moved',
+		},
+	}`)
+	resp, body = do("POST", "/api/greet/hello", `{}`)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "https://example.com", resp.Header.Get("Location"))
+	require.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	require.Equal(t, "moved", body)
+
+	ts.Overrides.Set("", "greet.Greeter.Hello", `function(input) {
+		status: { code: 5, message: 'gone' },
+		http: { status: 410 },
+	}`)
+	resp, body = do("POST", "/api/greet/hello", `{}`)
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	require.JSONEq(t, `{"code": 5, "message": "gone"}`, body)
+}
+
+func TestHTTPBody(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/rawgreet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler())
+	do := func(method, path, contentType string, body io.Reader) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://jig"+path, body)
+		require.NoError(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", "*/*")
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(raw)
+	}
+
+	t.Run("response", func(t *testing.T) {
+		resp, body := do("GET", "/api/rawgreet/card/Kitty.html", "", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+		require.Equal(t, "<h1>💃 Hello Kitty</h1>", body)
+
+		resp, body = do("GET", "/api/rawgreet/card/Kitty.txt", "", nil)
+		require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.Equal(t, "💃 Hello Kitty", body)
+
+		// Errors are not raw.
+		resp, body = do("GET", "/api/rawgreet/card/Kitty.gif", "", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		require.JSONEq(t, `{"code": 5, "message": "no card for Kitty.gif"}`, body)
+	})
+
+	t.Run("streamed response", func(t *testing.T) {
+		resp, body := do("GET", "/api/rawgreet/cards/Kitty", "", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		require.Equal(t, "name,greeting\nKitty,hello\nKitty,goodbye\n", body)
+	})
+
+	t.Run("request", func(t *testing.T) {
+		resp, body := do("POST", "/api/rawgreet/upload", "text/plain", strings.NewReader("hi there"))
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.JSONEq(t, `{"summary": "text/plain: hi there"}`, body)
+	})
+
+	t.Run("request field", func(t *testing.T) {
+		resp, body := do("PUT", "/api/rawgreet/upload/card1", "text/csv", strings.NewReader("a,b"))
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.JSONEq(t, `{"summary": "card1 (text/csv): a,b"}`, body)
+	})
+
+	t.Run("streamed request", func(t *testing.T) {
+		data := bytes.Repeat([]byte{0xff}, httpBodyChunkSize*2+10)
+		resp, body := do("POST", "/api/rawgreet/uploadstream", "application/octet-stream", bytes.NewReader(data))
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		require.JSONEq(t, fmt.Sprintf(`{"summary": "3 chunks of application/octet-stream, %d bytes"}`, len(data)), body)
+	})
+}
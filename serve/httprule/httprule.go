@@ -1,17 +1,23 @@
 package httprule
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"path/filepath"
-	"regexp"
+	"net/url"
 	"strconv"
 	"strings"
 
 	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
@@ -36,112 +42,420 @@ func MatchRequest(rule *annotations.HttpRule, req *http.Request) map[string]stri
 	if req.Method != method {
 		return nil
 	}
-	return matchPath(pattern, req.URL.Path)
+	return matchPath(pattern, req.URL.EscapedPath())
+}
+
+// ParseRule parses an HttpRule from its short form "METHOD PATH [BODY]", such
+// as "POST /api/{package}.{service}/{method} *". BODY defaults to "*" for
+// POST, PUT and PATCH rules and is empty otherwise. Methods other than GET,
+// PUT, POST, DELETE and PATCH make custom rules.
+func ParseRule(s string) (*annotations.HttpRule, error) {
+	parts := strings.Fields(s)
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid HttpRule %q: want METHOD PATH [BODY]", s)
+	}
+	method, path := strings.ToUpper(parts[0]), parts[1]
+	if _, err := parseTemplate(interpolate(path, "pkg", "Service", "Method")); err != nil {
+		return nil, fmt.Errorf("invalid HttpRule %q: %w", s, err)
+	}
+	rule := &annotations.HttpRule{}
+	switch method {
+	case http.MethodGet:
+		rule.Pattern = &annotations.HttpRule_Get{Get: path}
+	case http.MethodPut:
+		rule.Pattern, rule.Body = &annotations.HttpRule_Put{Put: path}, "*"
+	case http.MethodPost:
+		rule.Pattern, rule.Body = &annotations.HttpRule_Post{Post: path}, "*"
+	case http.MethodDelete:
+		rule.Pattern = &annotations.HttpRule_Delete{Delete: path}
+	case http.MethodPatch:
+		rule.Pattern, rule.Body = &annotations.HttpRule_Patch{Patch: path}, "*"
+	default:
+		rule.Pattern = &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{Kind: method, Path: path}}
+	}
+	if len(parts) == 3 {
+		rule.Body = parts[2]
+	}
+	return rule, nil
 }
 
 const (
 	ContentTypeBinaryProto = "application/x-protobuf"
 	ContentTypeJSON        = "application/json"
+	// ContentTypeNDJSON and ContentTypeEventStream are accepted as response
+	// framings for server-streaming methods.
+	ContentTypeNDJSON      = "application/x-ndjson"
+	ContentTypeEventStream = "text/event-stream"
+	// ContentTypeTextProto is the protobuf text format and ContentTypeYAML
+	// the YAML form of the JSON encoding of messages.
+	ContentTypeTextProto = "text/x-protobuf"
+	ContentTypeYAML      = "application/yaml"
 )
 
-// DecodeRequest parses a http.Request, using a HttpRule, into a target message.
+// DecodeRequest parses a http.Request, using a HttpRule, into a target
+// message. Fields are set from the request body as selected by the rule,
+// from the path vars, and from the query parameters for fields that are not
+// bound by the body or path.
 func DecodeRequest(rule *annotations.HttpRule, pathVars map[string]string, req *http.Request, target proto.Message) error {
 	if err := decodeBody(rule, req, target); err != nil {
 		return err
 	}
+	return setURLVars(rule, pathVars, req, target)
+}
 
+// setURLVars sets the fields of target from the query parameters and path
+// vars of req.
+func setURLVars(rule *annotations.HttpRule, pathVars map[string]string, req *http.Request, target proto.Message) error {
+	if err := setQueryParams(rule, pathVars, req.URL.Query(), target); err != nil {
+		return err
+	}
+	return setPathVars(target, pathVars)
+}
+
+// setQueryParams sets fields of target from query parameters, named by
+// (possibly dotted) field paths. Fields bound by the rule's body or by path
+// vars are not set. Repeated fields take all values of a parameter. Unknown
+// parameters are ignored.
+func setQueryParams(rule *annotations.HttpRule, pathVars map[string]string, query url.Values, target proto.Message) error {
+	if rule.Body == "*" {
+		return nil
+	}
+	tb := target.ProtoReflect()
+	for key, values := range query {
+		if isBound(key, rule.Body, pathVars) {
+			continue
+		}
+		for _, value := range values {
+			err := setField(target, key, value)
+			if errors.Is(err, errNoSuchField) {
+				break
+			}
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "%s: query parameter %s: %v", tb.Descriptor().FullName(), key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isBound returns true if the field path is bound by the body field path or
+// path vars, or is the parent or a child of a bound field.
+func isBound(fieldPath, body string, pathVars map[string]string) bool {
+	overlaps := func(bound string) bool {
+		return bound == fieldPath || strings.HasPrefix(fieldPath, bound+".") || strings.HasPrefix(bound, fieldPath+".")
+	}
+	if body != "" && overlaps(body) {
+		return true
+	}
+	for key := range pathVars {
+		if overlaps(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func setPathVars(target proto.Message, pathVars map[string]string) error {
 	tb := target.ProtoReflect()
-	// First set fields from path vars.
 	for key, value := range pathVars {
 		if err := setField(target, key, value); err != nil {
-			return fmt.Errorf("%s: field %s: %w", tb.Descriptor().FullName(), key, err)
+			return status.Errorf(codes.InvalidArgument, "%s: field %s: %v", tb.Descriptor().FullName(), key, err)
 		}
 	}
-
 	return nil
 }
 
 func decodeBody(rule *annotations.HttpRule, req *http.Request, target proto.Message) error {
-	if rule.Body != "*" {
+	if rule.Body == "" {
 		// If body isn't set, the request body is dropped.
-		// TODO: Support field paths other than "*".
 		return nil
 	}
-	mediaType := ContentTypeJSON
+	if hb := httpBodyTarget(rule.Body, target); hb != nil {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		setHTTPBody(hb, req.Header.Get("Content-Type"), data)
+		return nil
+	}
+	mediaType, err := requestMediaType(req)
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return unmarshalBody(rule.Body, mediaType, raw, target)
+}
+
+// httpBodyName is the name of the google.api.HttpBody message, which
+// carries raw HTTP bodies with their content type rather than encoded
+// messages.
+const httpBodyName protoreflect.FullName = "google.api.HttpBody"
+
+// isHTTPBody returns true if the part of messages of type md selected by
+// body, either "*" or "" for the whole message or the name of a top-level
+// field, is a google.api.HttpBody.
+func isHTTPBody(md protoreflect.MessageDescriptor, body string) bool {
+	if body == "" || body == "*" {
+		return md.FullName() == httpBodyName
+	}
+	fd := findField(md, body)
+	return fd != nil && isMessageField(fd) && fd.Message().FullName() == httpBodyName
+}
+
+// httpBodyTarget returns the google.api.HttpBody of target that the
+// request body is bound to by body, or nil if the body is not bound to an
+// HttpBody.
+func httpBodyTarget(body string, target proto.Message) protoreflect.Message {
+	m := target.ProtoReflect()
+	if body == "" || !isHTTPBody(m.Descriptor(), body) {
+		return nil
+	}
+	if body == "*" {
+		return m
+	}
+	return m.Mutable(findField(m.Descriptor(), body)).Message()
+}
+
+// httpBodyResponse returns the google.api.HttpBody of the response m
+// selected by responseBody, or nil if it is not an HttpBody.
+func httpBodyResponse(responseBody string, m proto.Message) protoreflect.Message {
+	mr := m.ProtoReflect()
+	if !isHTTPBody(mr.Descriptor(), responseBody) {
+		return nil
+	}
+	if responseBody == "" {
+		return mr
+	}
+	return mr.Get(findField(mr.Descriptor(), responseBody)).Message()
+}
+
+func setHTTPBody(hb protoreflect.Message, contentType string, data []byte) {
+	fields := hb.Descriptor().Fields()
+	hb.Set(fields.ByName("content_type"), protoreflect.ValueOfString(contentType))
+	hb.Set(fields.ByName("data"), protoreflect.ValueOfBytes(data))
+}
+
+// getHTTPBody returns the content type and data of a google.api.HttpBody.
+func getHTTPBody(hb protoreflect.Message) (string, []byte) {
+	fields := hb.Descriptor().Fields()
+	return hb.Get(fields.ByName("content_type")).String(), hb.Get(fields.ByName("data")).Bytes()
+}
+
+// unmarshalBody unmarshals raw, encoded as mediaType, into the part of
+// target selected by body: either "*" for the whole message, or the name of
+// a top-level field. A binary or text format body can only be unmarshaled
+// into a message field.
+func unmarshalBody(body, mediaType string, raw []byte, target proto.Message) error {
+	if mediaType == ContentTypeYAML {
+		var err error
+		if raw, err = yamlToJSON(raw); err != nil {
+			return err
+		}
+		mediaType = ContentTypeJSON
+	}
+	isJSON := mediaType == ContentTypeJSON || mediaType == ContentTypeNDJSON
+	unmarshal := proto.Unmarshal
+	switch {
+	case isJSON:
+		unmarshal = protojson.Unmarshal
+	case mediaType == ContentTypeTextProto:
+		unmarshal = prototext.Unmarshal
+	case mediaType != ContentTypeBinaryProto:
+		return fmt.Errorf("invalid content type %s", mediaType)
+	}
+	if body == "*" {
+		return unmarshal(raw, target)
+	}
+
+	m := target.ProtoReflect()
+	fd := findField(m.Descriptor(), body)
+	if fd == nil {
+		return fmt.Errorf("body field %s: %w", body, errNoSuchField)
+	}
+	if !isJSON {
+		if !isMessageField(fd) {
+			return fmt.Errorf("cannot unmarshal %s into non-message body field %s", mediaType, body)
+		}
+		return unmarshal(raw, m.Mutable(fd).Message().Interface())
+	}
+	// Unmarshal the field as a whole message so protojson handles the field
+	// type, then move the field to target.
+	wrapped := make([]byte, 0, len(raw)+len(fd.JSONName())+5)
+	wrapped = append(wrapped, `{"`+fd.JSONName()+`":`...)
+	wrapped = append(wrapped, raw...)
+	wrapped = append(wrapped, '}')
+	tmp := m.New()
+	if err := protojson.Unmarshal(wrapped, tmp.Interface()); err != nil {
+		return err
+	}
+	if tmp.Has(fd) {
+		m.Set(fd, tmp.Get(fd))
+	}
+	return nil
+}
+
+func isMessageField(fd protoreflect.FieldDescriptor) bool {
+	return fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap()
+}
+
+// requestMediaType returns the media type of the body of req, from its
+// Content-Type header, or its Accept header if it has no Content-Type.
+func requestMediaType(req *http.Request) (string, error) {
 	contentType := req.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = req.Header.Get("Accept")
 	}
-	var err error
-	if contentType != "" {
-		mediaType, _, err = mime.ParseMediaType(contentType)
-		if err != nil {
+	if contentType == "" {
+		return ContentTypeJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// requestStream decodes the request messages of a client-streaming method
+// from a HTTP request body. The framing of the messages is given by the
+// Content-Type of the request:
+//
+//   - application/x-ndjson: one JSON message per line.
+//   - application/x-protobuf: varint length-delimited binary messages.
+//   - application/json, application/yaml and text/x-protobuf: a single
+//     message.
+//
+// If the rule binds the body to a google.api.HttpBody, the raw body is
+// streamed in chunks of any content type instead.
+//
+// Each message is unmarshaled into the part of the request selected by the
+// rule's body. If the rule does not map the body to the request, the stream
+// has a single message set from the URL.
+type requestStream struct {
+	rule *annotations.HttpRule
+	vars map[string]string
+	req  *http.Request
+
+	mediaType string
+	body      *bufio.Reader
+	done      bool
+}
+
+// next decodes the next request message into target, returning io.EOF
+// at the end of the stream.
+func (rs *requestStream) next(target proto.Message) error {
+	if rs.done {
+		return io.EOF
+	}
+	if rs.rule.Body == "" {
+		rs.done = true
+		return setURLVars(rs.rule, rs.vars, rs.req, target)
+	}
+	if hb := httpBodyTarget(rs.rule.Body, target); hb != nil {
+		if err := rs.nextHTTPBody(hb); err != nil {
+			return err
+		}
+		return setURLVars(rs.rule, rs.vars, rs.req, target)
+	}
+	if rs.body == nil {
+		var err error
+		if rs.mediaType, err = requestMediaType(rs.req); err != nil {
 			return err
 		}
+		rs.body = bufio.NewReader(rs.req.Body)
 	}
-	var unmarshal func(b []byte, m proto.Message) error
-	switch mediaType {
+	var raw []byte
+	var err error
+	switch rs.mediaType {
+	case ContentTypeNDJSON:
+		raw, err = readLine(rs.body)
 	case ContentTypeBinaryProto:
-		unmarshal = proto.Unmarshal
-	case ContentTypeJSON:
-		unmarshal = protojson.Unmarshal
+		raw, err = readDelimited(rs.body)
+	case ContentTypeJSON, ContentTypeYAML, ContentTypeTextProto:
+		rs.done = true
+		raw, err = io.ReadAll(rs.body)
 	default:
-		return fmt.Errorf("invalid content type %s", contentType)
+		err = fmt.Errorf("invalid content type %s", rs.mediaType)
 	}
-
-	raw, err := io.ReadAll(req.Body)
 	if err != nil {
 		return err
 	}
-	if err = unmarshal(raw, target); err != nil {
+	if err := unmarshalBody(rs.rule.Body, rs.mediaType, raw, target); err != nil {
 		return err
 	}
-
-	return nil
+	return setURLVars(rs.rule, rs.vars, rs.req, target)
 }
 
-var matchSplit = regexp.MustCompile(`/|{[^}]*}|[^/]+`)
+// httpBodyChunkSize is the maximum size of the data of each HttpBody
+// message of a client-streaming request.
+const httpBodyChunkSize = 32 * 1024
 
-func matchPath(pattern, path string) map[string]string {
-	vars := map[string]string{}
-	patparts := matchSplit.FindAllString(pattern, -1)
-	pathparts := matchSplit.FindAllString(path, -1)
-	for _, pat := range patparts {
-		if len(pathparts) == 0 {
-			return nil
-		}
-		pathpart := pathparts[0]
-		pathparts = pathparts[1:]
-		if pathpart == pat {
-			continue
+// nextHTTPBody sets hb to the next chunk of the raw request body, with the
+// content type of the request.
+func (rs *requestStream) nextHTTPBody(hb protoreflect.Message) error {
+	if rs.body == nil {
+		rs.body = bufio.NewReader(rs.req.Body)
+	}
+	data := make([]byte, httpBodyChunkSize)
+	n, err := io.ReadFull(rs.body, data)
+	switch {
+	case n == 0 && err != nil:
+		rs.done = true
+		if errors.Is(err, io.EOF) {
+			return io.EOF
 		}
+		return err
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		rs.done = true
+	case err != nil:
+		return err
+	}
+	setHTTPBody(hb, rs.req.Header.Get("Content-Type"), data[:n])
+	return nil
+}
 
-		if !strings.HasPrefix(pat, "{") {
-			return nil
+// readDelimited returns the next varint length-delimited message of r, or
+// io.EOF if there is none.
+func readDelimited(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, err
+	}
+	return b, nil
+}
 
-		key := pat[1 : len(pat)-1]
-
-		// Do glob match {name=foo/*}
-		keyparts := strings.SplitN(key, "=", 2)
-		if len(keyparts) > 1 {
-			key = keyparts[0]
-			glob := keyparts[1]
-			remainder := pathpart + strings.Join(pathparts, "")
-			if ok, _ := filepath.Match(glob, remainder); ok {
-				pathparts = nil
-				vars[key] = remainder
-				break
-			} else {
-				return nil
-			}
+// readLine returns the next non-blank line of r, or io.EOF if there is none.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
 		}
-		vars[key] = pathpart
 	}
-	if len(pathparts) > 0 {
+}
+
+// matchPath matches an escaped URL path against a path template, returning
+// the extracted path vars or nil if the path does not match or the template
+// is invalid.
+func matchPath(pattern, path string) map[string]string {
+	tmpl, err := parseTemplate(pattern)
+	if err != nil {
 		return nil
 	}
-	return vars
+	return tmpl.match(path)
 }
 
 func extractSelect(rule *annotations.HttpRule) (method, path string) {
@@ -163,11 +477,31 @@ func extractSelect(rule *annotations.HttpRule) (method, path string) {
 	}
 }
 
+var errNoSuchField = errors.New("no such field")
+
+// setField sets the field at the dotted field path name of target from its
+// string value, creating intermediate messages as needed. If the field is
+// repeated, the value is appended. Fields can be named by their proto or
+// JSON name.
 func setField(target proto.Message, name, valstr string) error {
 	m := target.ProtoReflect()
-	fd := m.Descriptor().Fields().ByTextName(name)
+	parts := strings.Split(name, ".")
+	for _, part := range parts[:len(parts)-1] {
+		fd := findField(m.Descriptor(), part)
+		if fd == nil {
+			return errNoSuchField
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("%s is not a singular message field", part)
+		}
+		m = m.Mutable(fd).Message()
+	}
+	fd := findField(m.Descriptor(), parts[len(parts)-1])
 	if fd == nil {
-		return fmt.Errorf("no such field")
+		return errNoSuchField
+	}
+	if fd.IsMap() {
+		return fmt.Errorf("unsupported map field")
 	}
 
 	var val interface{}
@@ -201,6 +535,16 @@ func setField(target proto.Message, name, valstr string) error {
 		val, err = valstr, nil
 	case protoreflect.BytesKind:
 		val, err = []byte(valstr), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(valstr)); ev != nil {
+			val = ev.Number()
+		} else {
+			var v int64
+			v, err = strconv.ParseInt(valstr, 10, 32)
+			val = protoreflect.EnumNumber(v)
+		}
+	case protoreflect.MessageKind:
+		val, err = parseWellKnown(m, fd, valstr)
 	default:
 		err = fmt.Errorf("unsupported type %s", fd.Kind())
 	}
@@ -216,3 +560,34 @@ func setField(target proto.Message, name, valstr string) error {
 	}
 	return nil
 }
+
+// parseWellKnown returns a new message for the field fd of m, parsed from
+// the JSON scalar form of its well-known type, e.g. an RFC 3339 timestamp
+// or a "1.5s" duration.
+func parseWellKnown(m protoreflect.Message, fd protoreflect.FieldDescriptor, valstr string) (protoreflect.Message, error) {
+	schema := scalarWellKnownSchema(fd.Message().FullName())
+	if schema == nil {
+		return nil, fmt.Errorf("unsupported message type %s", fd.Message().FullName())
+	}
+	var v protoreflect.Message
+	if fd.IsList() {
+		v = m.Mutable(fd).List().NewElement().Message()
+	} else {
+		v = m.NewField(fd).Message()
+	}
+	data := valstr
+	if schema.Type == "string" {
+		data = strconv.Quote(valstr)
+	}
+	if err := protojson.Unmarshal([]byte(data), v.Interface()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func findField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if fd := md.Fields().ByTextName(name); fd != nil {
+		return fd
+	}
+	return md.Fields().ByJSONName(name)
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"io"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 
+	"foxygo.at/jig/pb/exemplar"
 	"foxygo.at/jig/pb/httpgreet"
 )
 
@@ -23,8 +27,30 @@ func TestMatchPath(t *testing.T) {
 		{"/api/hello/{name}", "/api/hello/nobody", map[string]string{"name": "nobody"}},
 		{"/v1/{name=messages/*}", "/v1/messages/12345", map[string]string{"name": "messages/12345"}},
 		{"/v1/{name=messages/*}", "/v1/messages/12345", map[string]string{"name": "messages/12345"}},
-		// TODO: Support **
-		//{"/v1/{name=**}", "/v1/messages/12345", map[string]string{"name": "messages/12345"}},
+		{"/v1/{name=**}", "/v1/messages/12345", map[string]string{"name": "messages/12345"}},
+		{"/v1/{name=**}", "/v1", map[string]string{"name": ""}},
+		{"/v1/{name=messages/**}", "/v1/messages/a/b/c", map[string]string{"name": "messages/a/b/c"}},
+		{"/v1/{name=messages/**}", "/v1/other/a", nil},
+		{"/v1/*/{id}", "/v1/shelves/1", map[string]string{"id": "1"}},
+		{"/v1/*/{id}", "/v1//1", nil},
+		{"/v1/{book.name}", "/v1/moby", map[string]string{"book.name": "moby"}},
+		{"/v1/{book.name=shelves/*/books/*}", "/v1/shelves/1/books/2", map[string]string{"book.name": "shelves/1/books/2"}},
+		{"/v1/{book.name=shelves/*/books/*}", "/v1/shelves/1/books", nil},
+		{"/v1/{parent=shelves/*}/books/{id}", "/v1/shelves/1/books/2", map[string]string{"parent": "shelves/1", "id": "2"}},
+		{"/v1/books:batchGet", "/v1/books:batchGet", map[string]string{}},
+		{"/v1/books:batchGet", "/v1/books", nil},
+		{"/v1/books:batchGet", "/v1/books:batchDelete", nil},
+		{"/v1/{name=books/*}:undelete", "/v1/books/1:undelete", map[string]string{"name": "books/1"}},
+		{"/v1/{name=**}:undelete", "/v1/a/b:undelete", map[string]string{"name": "a/b"}},
+		{"/v1/{name}", "/v1/a:b", map[string]string{"name": "a:b"}},
+		// Single segment variables are fully unescaped, multi segment
+		// variables keep %2F.
+		{"/v1/{name}", "/v1/a%2Fb%20c", map[string]string{"name": "a/b c"}},
+		{"/v1/{name=**}", "/v1/a%2Fb/c%20d", map[string]string{"name": "a%2Fb/c d"}},
+		{"/v1/hello%20world", "/v1/hello%20world", nil},
+		{"/v1/{name}", "/v1/bad%zz", nil},
+		// Invalid templates never match.
+		{"/v1/{name=**}/x", "/v1/a/x", nil},
 	}
 	for _, test := range tests {
 		require.Equalf(t,
@@ -34,6 +60,103 @@ func TestMatchPath(t *testing.T) {
 	}
 }
 
+func TestParseTemplate(t *testing.T) {
+	valid := []string{
+		"/",
+		"/v1",
+		"/v1/*",
+		"/v1/**",
+		"/v1/{a}/{b=*}/{c=x/*/y/**}",
+		"/v1/{a.b_c.d2}",
+		"/v1/books:batchGet",
+		"/v1/{name=**}:verb",
+	}
+	for _, tmpl := range valid {
+		_, err := parseTemplate(tmpl)
+		require.NoErrorf(t, err, "template %q", tmpl)
+	}
+	invalid := []string{
+		"",
+		"v1",
+		"/v1/",
+		"/v1//a",
+		"/v1/**/a",
+		"/v1/{a=**}/b",
+		"/v1/{a",
+		"/v1/{}",
+		"/v1/{a..b}",
+		"/v1/{1a}",
+		"/v1/{a={b}}",
+		"/v1/{a}/{a}",
+		"/v1/a:",
+		"/v1/a:b/c",
+		"/v1/a}",
+	}
+	for _, tmpl := range invalid {
+		_, err := parseTemplate(tmpl)
+		require.Errorf(t, err, "template %q", tmpl)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := map[string]*annotations.HttpRule{
+		"GET /v1/{method}": {
+			Pattern: &annotations.HttpRule_Get{Get: "/v1/{method}"},
+		},
+		"post /{package}.{service}/{method}": {
+			Pattern: &annotations.HttpRule_Post{Post: "/{package}.{service}/{method}"},
+			Body:    "*",
+		},
+		"PUT /v1/{name=things/*} thing": {
+			Pattern: &annotations.HttpRule_Put{Put: "/v1/{name=things/*}"},
+			Body:    "thing",
+		},
+		"DELETE /v1/{name=**}": {
+			Pattern: &annotations.HttpRule_Delete{Delete: "/v1/{name=**}"},
+		},
+		"  PATCH\t/v1/{method}  ": {
+			Pattern: &annotations.HttpRule_Patch{Patch: "/v1/{method}"},
+			Body:    "*",
+		},
+		"HEAD /v1/{method}": {
+			Pattern: &annotations.HttpRule_Custom{Custom: &annotations.CustomHttpPattern{Kind: "HEAD", Path: "/v1/{method}"}},
+		},
+	}
+	for s, want := range tests {
+		rule, err := ParseRule(s)
+		require.NoErrorf(t, err, "rule %q", s)
+		require.Truef(t, proto.Equal(want, rule), "rule %q: got %v", s, rule)
+	}
+	invalid := []string{
+		"",
+		"GET",
+		"/v1/{method}",
+		"GET v1/{method}",
+		"GET /v1/{method} * extra",
+	}
+	for _, s := range invalid {
+		_, err := ParseRule(s)
+		require.Errorf(t, err, "rule %q", s)
+	}
+}
+
+func TestDecodeNestedPathVars(t *testing.T) {
+	rule := &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/{a_message.field=fields/*}/{recursive.a_string}"},
+	}
+	req := httptest.NewRequest("GET", "/v1/fields/f%2F1/nested", nil)
+	vars := MatchRequest(rule, req)
+	require.Equal(t, map[string]string{"a_message.field": "fields/f%2F1", "recursive.a_string": "nested"}, vars)
+
+	actual := &exemplar.SampleResponse{}
+	require.NoError(t, DecodeRequest(rule, vars, req, actual))
+	expected := &exemplar.SampleResponse{
+		AMessage:  &exemplar.SampleResponse_SampleMessage1{Field: "fields/f%2F1"},
+		Recursive: &exemplar.SampleResponse{AString: "nested"},
+	}
+	require.Truef(t, proto.Equal(expected, actual), "expected: %s,\nactual: %s", expected, actual)
+}
+
 func TestDecodeRequest(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -141,3 +264,80 @@ func TestDecodeRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeQueryParams(t *testing.T) {
+	rule := &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/samples/{a_string}"},
+	}
+	query := "a_string=ignored&aInt32=-5&a_bool=true&a_enum=SAMPLE_ENUM_SECOND" +
+		"&a_message.field=nested&a_message.repeat=1&a_message.repeat=2" +
+		"&a_int_list=3&a_int_list=4&unknown=x"
+	req := httptest.NewRequest("GET", "/v1/samples/path?"+query, nil)
+	vars := MatchRequest(rule, req)
+	require.NotNil(t, vars)
+
+	actual := &exemplar.SampleResponse{}
+	require.NoError(t, DecodeRequest(rule, vars, req, actual))
+	expected := &exemplar.SampleResponse{
+		AString: "path",
+		AInt32:  -5,
+		ABool:   true,
+		AEnum:   exemplar.SampleResponse_SAMPLE_ENUM_SECOND,
+		AMessage: &exemplar.SampleResponse_SampleMessage1{
+			Field:  "nested",
+			Repeat: []int32{1, 2},
+		},
+		AIntList: []int32{3, 4},
+	}
+	require.Truef(t, proto.Equal(expected, actual), "expected: %s,\nactual: %s", expected, actual)
+
+	req = httptest.NewRequest("GET", "/v1/samples/path?a_int32=x", nil)
+	err := DecodeRequest(rule, vars, req, &exemplar.SampleResponse{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Query parameters are ignored if the body is mapped to the request.
+	rule.Body = "*"
+	req = httptest.NewRequest("GET", "/v1/samples/path?a_int32=1", strings.NewReader("{}"))
+	actual = &exemplar.SampleResponse{}
+	require.NoError(t, DecodeRequest(rule, vars, req, actual))
+	require.Zero(t, actual.AInt32)
+}
+
+func TestDecodeBodyField(t *testing.T) {
+	rule := &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Post{Post: "/v1/samples/{a_string}"},
+		Body:    "a_message",
+	}
+	body := `{"field": "body", "repeat": [1, 2]}`
+	req := httptest.NewRequest("POST", "/v1/samples/path?a_int32=3&a_message.field=ignored", strings.NewReader(body))
+	vars := MatchRequest(rule, req)
+	require.NotNil(t, vars)
+
+	actual := &exemplar.SampleResponse{}
+	require.NoError(t, DecodeRequest(rule, vars, req, actual))
+	expected := &exemplar.SampleResponse{
+		AString: "path",
+		AInt32:  3,
+		AMessage: &exemplar.SampleResponse_SampleMessage1{
+			Field:  "body",
+			Repeat: []int32{1, 2},
+		},
+	}
+	require.Truef(t, proto.Equal(expected, actual), "expected: %s,\nactual: %s", expected, actual)
+
+	// Non-message fields can be bound to the body as JSON.
+	rule.Body = "a_int_list"
+	req = httptest.NewRequest("POST", "/v1/samples/path", strings.NewReader("[4, 5]"))
+	actual = &exemplar.SampleResponse{}
+	require.NoError(t, DecodeRequest(rule, vars, req, actual))
+	require.Equal(t, []int32{4, 5}, actual.AIntList)
+
+	// Binary bodies can only be bound to message fields.
+	req = httptest.NewRequest("POST", "/v1/samples/path", bytes.NewReader(nil))
+	req.Header.Set("Content-Type", ContentTypeBinaryProto)
+	require.Error(t, DecodeRequest(rule, vars, req, &exemplar.SampleResponse{}))
+
+	rule.Body = "no_such_field"
+	req = httptest.NewRequest("POST", "/v1/samples/path", strings.NewReader("{}"))
+	require.Error(t, DecodeRequest(rule, vars, req, &exemplar.SampleResponse{}))
+}
@@ -0,0 +1,119 @@
+package httprule
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"foxygo.at/jig/serve"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// MetadataHeaderPrefix is the prefix of HTTP request headers forwarded
+	// as incoming metadata without the prefix, and the default prefix of
+	// HTTP response headers carrying the header metadata of a method.
+	MetadataHeaderPrefix = "Grpc-Metadata-"
+	// MetadataTrailerPrefix is the default prefix of HTTP response trailers
+	// carrying the trailer metadata of a method.
+	MetadataTrailerPrefix = "Grpc-Trailer-"
+)
+
+// headerPrefix maps HTTP headers starting with http to metadata keys,
+// replacing the prefix with md.
+type headerPrefix struct {
+	http string
+	md   string
+}
+
+// defaultHeaderPrefixes are the HTTP request headers forwarded as incoming
+// metadata by default: "Grpc-Metadata-" headers, and the "X-Jig-" headers
+// selecting sessions and scenarios.
+var defaultHeaderPrefixes = []headerPrefix{
+	{http: MetadataHeaderPrefix, md: ""},
+	{http: "X-Jig-", md: "x-jig-"},
+}
+
+// WithIncomingHeaders is an [Option] to configure a [Handler] to forward the
+// named HTTP request headers to methods as incoming metadata, keyed by the
+// lowercase header name.
+func WithIncomingHeaders(names ...string) Option {
+	return func(h *Handler) error {
+		for _, name := range names {
+			h.incomingHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+		return nil
+	}
+}
+
+// WithIncomingHeaderPrefix is an [Option] to configure a [Handler] to forward
+// HTTP request headers starting with httpPrefix to methods as incoming
+// metadata, with httpPrefix replaced by mdPrefix in the metadata key. The
+// prefixes are added to the default ones, which forward "Grpc-Metadata-"
+// headers without the prefix and "X-Jig-" headers as they are.
+func WithIncomingHeaderPrefix(httpPrefix, mdPrefix string) Option {
+	return func(h *Handler) error {
+		h.incomingPrefixes = append(h.incomingPrefixes, headerPrefix{
+			http: http.CanonicalHeaderKey(httpPrefix),
+			md:   strings.ToLower(mdPrefix),
+		})
+		return nil
+	}
+}
+
+// WithOutgoingHeaderPrefix is an [Option] to configure the prefixes of the
+// HTTP response headers and trailers carrying the header and trailer
+// metadata set by methods. They default to [MetadataHeaderPrefix] and
+// [MetadataTrailerPrefix]. Empty prefixes write the metadata keys as they
+// are.
+func WithOutgoingHeaderPrefix(headerPrefix, trailerPrefix string) Option {
+	return func(h *Handler) error {
+		h.headerPrefix = headerPrefix
+		h.trailerPrefix = trailerPrefix
+		return nil
+	}
+}
+
+// incomingMetadata returns the forwarded headers of r as metadata.
+func (h *Handler) incomingMetadata(r *http.Request) metadata.MD {
+	return serve.IncomingMetadata(r.Header, h.metadataKey)
+}
+
+// metadataKey returns the metadata key a header is forwarded as, if any.
+func (h *Handler) metadataKey(name string) (string, bool) {
+	if h.incomingHeaders[name] {
+		return strings.ToLower(name), true
+	}
+	for _, p := range h.incomingPrefixes {
+		if rest, ok := strings.CutPrefix(name, p.http); ok && rest != "" {
+			return p.md + strings.ToLower(rest), true
+		}
+	}
+	return "", false
+}
+
+// writeMetadata adds md to the HTTP header with each key prefixed by
+// prefix. Values of binary metadata keys are base64 encoded.
+func writeMetadata(header http.Header, md metadata.MD, prefix string) {
+	for key, values := range md {
+		for _, v := range values {
+			if strings.HasSuffix(key, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			header.Add(prefix+key, v)
+		}
+	}
+}
+
+// acceptsTrailers returns true if the client of r declared it accepts HTTP
+// trailers with a "TE: trailers" header.
+func acceptsTrailers(r *http.Request) bool {
+	for _, te := range r.Header.Values("TE") {
+		for _, v := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,483 @@
+package httprule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DefaultOpenAPIPath is the path a [Handler] serves its OpenAPI document
+// at when configured with [WithOpenAPI] and an empty path.
+const DefaultOpenAPIPath = "/openapi.json"
+
+// WithOpenAPI is an [Option] to configure a [Handler] to serve an OpenAPI 3
+// document of its methods, as returned by [Handler.OpenAPI], on GET
+// requests to path. An empty path serves it at [DefaultOpenAPIPath].
+func WithOpenAPI(path string) Option {
+	return func(h *Handler) error {
+		if path == "" {
+			path = DefaultOpenAPIPath
+		}
+		h.openAPIPath = path
+		return nil
+	}
+}
+
+// OpenAPI returns an OpenAPI 3 document, in JSON, describing the HTTP
+// methods of the handler. Each binding of an HttpRule is an operation
+// whose parameters are the path variables and, for fields not bound by
+// the path or the body, the query parameters of the rule. Messages are
+// described with schemas of their protojson encoding, and proto comments
+// become descriptions.
+func (h *Handler) OpenAPI() ([]byte, error) {
+	return json.MarshalIndent(newOpenAPIDoc(h.httpMethods), "", "  ")
+}
+
+func (h *Handler) serveOpenAPI(w http.ResponseWriter) {
+	b, err := h.OpenAPI()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	if _, err := w.Write(b); err != nil {
+		h.log.Errorf("failed to write OpenAPI document: %v", err)
+	}
+}
+
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Description string                       `json:"description,omitempty"`
+	Required    bool                         `json:"required"`
+	Content     map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+// openAPIMethods are the HTTP methods OpenAPI can describe operations of.
+var openAPIMethods = []string{
+	http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete,
+	http.MethodOptions, http.MethodHead, http.MethodPatch, http.MethodTrace,
+}
+
+// statusSchemaName is the schema of error responses, which is always
+// included as google.rpc.Status is not necessarily in the registry.
+const statusSchemaName = "google.rpc.Status"
+
+func newOpenAPIDoc(methods []*httpMethod) *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{Schemas: map[string]*openAPISchema{
+			statusSchemaName: {
+				Type:        "object",
+				Description: "The error status of a failed call.",
+				Properties: map[string]*openAPISchema{
+					"code":    {Type: "integer", Format: "int32"},
+					"message": {Type: "string"},
+					"details": {Type: "array", Items: &openAPISchema{Type: "object"}},
+				},
+			},
+		}},
+	}
+	var services []string
+	bindings := map[protoreflect.FullName]int{}
+	for _, m := range methods {
+		if !slices.Contains(openAPIMethods, m.httpMethod) {
+			continue
+		}
+		sd := m.desc.Parent().(protoreflect.ServiceDescriptor)
+		if !slices.Contains(services, string(sd.FullName())) {
+			services = append(services, string(sd.FullName()))
+		}
+		op := doc.operation(m)
+		op.OperationID = string(sd.Name()) + "_" + string(m.desc.Name())
+		if n := bindings[m.desc.FullName()]; n > 0 {
+			op.OperationID += fmt.Sprintf("_%d", n)
+		}
+		bindings[m.desc.FullName()]++
+		path := openAPIPath(m.tmpl)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(m.httpMethod)] = op
+	}
+	slices.Sort(services)
+	doc.Info = openAPIInfo{Title: strings.Join(services, ", "), Version: "0.0.0"}
+	if doc.Info.Title == "" {
+		doc.Info.Title = "jig"
+	}
+	return doc
+}
+
+func (doc *openAPIDoc) operation(m *httpMethod) *openAPIOperation {
+	input, output := m.desc.Input(), m.desc.Output()
+	op := &openAPIOperation{
+		Description: description(m.desc),
+		Tags:        []string{string(m.desc.Parent().Name())},
+		Responses: map[string]*openAPIResponse{
+			"default": {
+				Description: "Error status",
+				Content:     jsonContent(&openAPISchema{Ref: schemaRef(statusSchemaName)}),
+			},
+		},
+	}
+
+	var pathVars []string
+	for _, v := range m.tmpl.variables {
+		pathVars = append(pathVars, v.fieldPath)
+		op.Parameters = append(op.Parameters, &openAPIParameter{
+			Name:        v.fieldPath,
+			In:          "path",
+			Description: description(fieldByPath(input, v.fieldPath)),
+			Required:    true,
+			Schema:      doc.fieldSchema(fieldByPath(input, v.fieldPath)),
+		})
+	}
+	if m.rule.Body != "*" {
+		doc.queryParameters(op, input, "", "", m.rule.Body, pathVars, map[protoreflect.FullName]bool{})
+	}
+
+	if m.rule.Body != "" {
+		body := &openAPIRequestBody{Required: true}
+		if isHTTPBody(input, m.rule.Body) {
+			body.Content = rawContent()
+		} else if m.rule.Body == "*" {
+			body.Content = jsonContent(doc.messageSchema(input))
+		} else {
+			fd := findField(input, m.rule.Body)
+			body.Description = description(fd)
+			body.Content = jsonContent(doc.fieldSchema(fd))
+		}
+		if jsonBody := body.Content[ContentTypeJSON]; jsonBody != nil && m.desc.IsStreamingClient() {
+			body.Content[ContentTypeNDJSON] = jsonBody
+		}
+		op.RequestBody = body
+	}
+
+	resp := &openAPIResponse{Description: "OK"}
+	switch {
+	case isHTTPBody(output, m.rule.ResponseBody):
+		resp.Content = rawContent()
+	case m.rule.ResponseBody != "":
+		resp.Content = jsonContent(doc.fieldSchema(findField(output, m.rule.ResponseBody)))
+	default:
+		resp.Content = jsonContent(doc.messageSchema(output))
+	}
+	if schema := resp.Content[ContentTypeJSON]; schema != nil && m.desc.IsStreamingServer() {
+		resp.Description = "A stream of responses"
+		resp.Content[ContentTypeNDJSON] = schema
+		resp.Content[ContentTypeJSON] = &openAPIMediaType{Schema: &openAPISchema{Type: "array", Items: schema.Schema}}
+	}
+	op.Responses["200"] = resp
+	return op
+}
+
+// queryParameters adds the fields of md that are not bound by the rule's
+// body or path vars, or nested in bound fields, to op as query parameters,
+// named by the dotted JSON names of their field paths. Fields of nested
+// messages are flattened and well-known types with a JSON scalar form are
+// single parameters, while repeated messages, maps and other well-known
+// types cannot be set from query parameters.
+func (doc *openAPIDoc) queryParameters(op *openAPIOperation, md protoreflect.MessageDescriptor, protoPrefix, jsonPrefix, body string, pathVars []string, seen map[protoreflect.FullName]bool) {
+	if seen[md.FullName()] {
+		return
+	}
+	seen[md.FullName()] = true
+	defer delete(seen, md.FullName())
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		protoPath, jsonPath := protoPrefix+string(fd.Name()), jsonPrefix+fd.JSONName()
+		if isBoundBy(protoPath, body) || slices.ContainsFunc(pathVars, func(v string) bool { return isBoundBy(protoPath, v) }) {
+			continue
+		}
+		if fd.IsMap() || (fd.IsList() && fd.Kind() == protoreflect.MessageKind) {
+			continue
+		}
+		if fd.Kind() == protoreflect.MessageKind && wellKnownSchema(fd.Message().FullName()) == nil {
+			doc.queryParameters(op, fd.Message(), protoPath+".", jsonPath+".", body, pathVars, seen)
+			continue
+		}
+		if fd.Kind() == protoreflect.MessageKind && scalarWellKnownSchema(fd.Message().FullName()) == nil {
+			continue
+		}
+		op.Parameters = append(op.Parameters, &openAPIParameter{
+			Name:        jsonPath,
+			In:          "query",
+			Description: description(fd),
+			Schema:      doc.fieldSchema(fd),
+		})
+	}
+}
+
+// isBoundBy returns true if the field path is bound, or is a child of a
+// field path bound by the body or a path var.
+func isBoundBy(fieldPath, bound string) bool {
+	return bound != "" && (fieldPath == bound || strings.HasPrefix(fieldPath, bound+"."))
+}
+
+// messageSchema returns a reference to the schema of md, adding it and
+// the schemas of the messages it references to the document's components.
+func (doc *openAPIDoc) messageSchema(md protoreflect.MessageDescriptor) *openAPISchema {
+	if s := wellKnownSchema(md.FullName()); s != nil {
+		return s
+	}
+	name := string(md.FullName())
+	if _, ok := doc.Components.Schemas[name]; ok {
+		return &openAPISchema{Ref: schemaRef(name)}
+	}
+	s := &openAPISchema{
+		Type:        "object",
+		Description: description(md),
+		Properties:  map[string]*openAPISchema{},
+	}
+	// Add the schema before its fields, so recursive messages refer to it.
+	doc.Components.Schemas[name] = s
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		fs := doc.fieldSchema(fd)
+		if desc := description(fd); desc != "" && fs.Ref == "" {
+			fs.Description = desc
+		}
+		s.Properties[fd.JSONName()] = fs
+	}
+	return &openAPISchema{Ref: schemaRef(name)}
+}
+
+// fieldSchema returns the schema of the protojson encoding of fd.
+func (doc *openAPIDoc) fieldSchema(fd protoreflect.FieldDescriptor) *openAPISchema {
+	if fd == nil {
+		return &openAPISchema{}
+	}
+	if fd.IsMap() {
+		return &openAPISchema{Type: "object", AdditionalProperties: doc.valueSchema(fd.MapValue())}
+	}
+	if fd.IsList() {
+		return &openAPISchema{Type: "array", Items: doc.valueSchema(fd)}
+	}
+	return doc.valueSchema(fd)
+}
+
+// valueSchema returns the schema of a single value of fd.
+func (doc *openAPIDoc) valueSchema(fd protoreflect.FieldDescriptor) *openAPISchema {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return &openAPISchema{Type: "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return &openAPISchema{Type: "integer", Format: "uint32"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return &openAPISchema{Type: "string", Format: "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return &openAPISchema{Type: "string", Format: "uint64"}
+	case protoreflect.FloatKind:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case protoreflect.DoubleKind:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case protoreflect.StringKind:
+		return &openAPISchema{Type: "string"}
+	case protoreflect.BytesKind:
+		return &openAPISchema{Type: "string", Format: "byte"}
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		s := &openAPISchema{Type: "string", Enum: make([]string, values.Len())}
+		for i := range s.Enum {
+			s.Enum[i] = string(values.Get(i).Name())
+		}
+		return s
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return doc.messageSchema(fd.Message())
+	}
+	return &openAPISchema{}
+}
+
+// wellKnownSchema returns the schema of the well-known types with a
+// special protojson encoding, or nil for other messages.
+func wellKnownSchema(name protoreflect.FullName) *openAPISchema {
+	switch name {
+	case "google.protobuf.Timestamp":
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case "google.protobuf.Duration", "google.protobuf.FieldMask":
+		return &openAPISchema{Type: "string"}
+	case "google.protobuf.Struct", "google.protobuf.Any", "google.protobuf.Empty":
+		return &openAPISchema{Type: "object"}
+	case "google.protobuf.Value":
+		return &openAPISchema{}
+	case "google.protobuf.ListValue":
+		return &openAPISchema{Type: "array", Items: &openAPISchema{}}
+	case "google.protobuf.BoolValue":
+		return &openAPISchema{Type: "boolean"}
+	case "google.protobuf.Int32Value":
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case "google.protobuf.UInt32Value":
+		return &openAPISchema{Type: "integer", Format: "uint32"}
+	case "google.protobuf.Int64Value":
+		return &openAPISchema{Type: "string", Format: "int64"}
+	case "google.protobuf.UInt64Value":
+		return &openAPISchema{Type: "string", Format: "uint64"}
+	case "google.protobuf.FloatValue":
+		return &openAPISchema{Type: "number", Format: "float"}
+	case "google.protobuf.DoubleValue":
+		return &openAPISchema{Type: "number", Format: "double"}
+	case "google.protobuf.StringValue":
+		return &openAPISchema{Type: "string"}
+	case "google.protobuf.BytesValue":
+		return &openAPISchema{Type: "string", Format: "byte"}
+	}
+	return nil
+}
+
+// scalarWellKnownSchema returns the schema of a well-known type whose JSON
+// form is a string, number or boolean, or nil for other messages.
+func scalarWellKnownSchema(name protoreflect.FullName) *openAPISchema {
+	switch s := wellKnownSchema(name); {
+	case s == nil, s.Type == "object", s.Type == "array", s.Type == "":
+		return nil
+	default:
+		return s
+	}
+}
+
+func schemaRef(name string) string {
+	return "#/components/schemas/" + name
+}
+
+func jsonContent(s *openAPISchema) map[string]*openAPIMediaType {
+	return map[string]*openAPIMediaType{ContentTypeJSON: {Schema: s}}
+}
+
+// rawContent is the content of google.api.HttpBody requests and responses,
+// which can be of any media type.
+func rawContent() map[string]*openAPIMediaType {
+	return map[string]*openAPIMediaType{"*/*": {Schema: &openAPISchema{Type: "string", Format: "binary"}}}
+}
+
+// openAPIPath returns the OpenAPI path of a template, with its variables
+// as path parameters named by their field path. Unnamed "*" and "**"
+// segments cannot be expressed in OpenAPI and are kept as they are.
+func openAPIPath(t *pathTemplate) string {
+	var b strings.Builder
+	for i := 0; i < len(t.segments); i++ {
+		b.WriteByte('/')
+		if v, ok := t.variableAt(i); ok {
+			b.WriteString("{" + v.fieldPath + "}")
+			if v.end == -1 {
+				break
+			}
+			i = v.end - 1
+			continue
+		}
+		switch seg := t.segments[i]; seg.kind {
+		case literalSegment:
+			b.WriteString(seg.literal)
+		case wildcardSegment:
+			b.WriteString("*")
+		case multiSegment:
+			b.WriteString("**")
+		}
+	}
+	if b.Len() == 0 {
+		b.WriteByte('/')
+	}
+	if t.verb != "" {
+		b.WriteString(":" + t.verb)
+	}
+	return b.String()
+}
+
+// variableAt returns the variable starting at segment i, if any.
+func (t *pathTemplate) variableAt(i int) (variable, bool) {
+	for _, v := range t.variables {
+		if v.start == i {
+			return v, true
+		}
+	}
+	return variable{}, false
+}
+
+// fieldByPath returns the field of md at a dotted path of field names, or
+// nil if there is none.
+func fieldByPath(md protoreflect.MessageDescriptor, path string) protoreflect.FieldDescriptor {
+	var fd protoreflect.FieldDescriptor
+	for _, name := range strings.Split(path, ".") {
+		if md == nil {
+			return nil
+		}
+		if fd = findField(md, name); fd == nil {
+			return nil
+		}
+		md = fd.Message()
+	}
+	return fd
+}
+
+// description returns the leading comments of d in its source file, if
+// the file has source info.
+func description(d protoreflect.Descriptor) string {
+	if d == nil {
+		return ""
+	}
+	comments := d.ParentFile().SourceLocations().ByDescriptor(d).LeadingComments
+	lines := strings.Split(strings.TrimSpace(comments), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,185 @@
+package httprule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"foxygo.at/protog/registry"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"foxygo.at/jig/pb/exemplar"
+	"foxygo.at/jig/pb/httpgreet"
+)
+
+// newCommentedFiles returns a registry with the httpgreet file, with
+// comments on the GetHello method and the first_name request field.
+func newCommentedFiles(t *testing.T) *registry.Files {
+	t.Helper()
+	fdp := protodesc.ToFileDescriptorProto(httpgreet.File_httpgreet_httpgreet_proto)
+	comment := func(text string, path ...int32) *descriptorpb.SourceCodeInfo_Location {
+		return &descriptorpb.SourceCodeInfo_Location{Path: path, Span: []int32{0, 0, 0}, LeadingComments: &text}
+	}
+	fdp.SourceCodeInfo = &descriptorpb.SourceCodeInfo{Location: []*descriptorpb.SourceCodeInfo_Location{
+		comment(" GetHello greets\n by name.\n", 6, 0, 2, 0),
+		comment(" The name to greet.\n", 4, 0, 2, 0),
+	}}
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	files := new(registry.Files)
+	require.NoError(t, files.RegisterFile(fd))
+	return files
+}
+
+func TestOpenAPI(t *testing.T) {
+	h, err := NewHandler(newCommentedFiles(t), nil)
+	require.NoError(t, err)
+	b, err := h.OpenAPI()
+	require.NoError(t, err)
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(b, &doc))
+
+	get := jsonAt(t, doc, "paths", "/api/greet/hello/{first_name}", "get")
+	want := `{
+		"operationId": "HttpGreeter_GetHello",
+		"description": "GetHello greets\nby name.",
+		"tags": ["HttpGreeter"],
+		"parameters": [
+			{"name": "first_name", "in": "path", "required": true, "description": "The name to greet.", "schema": {"type": "string"}},
+			{"name": "lastName", "in": "query", "schema": {"type": "string"}}
+		],
+		"responses": {
+			"200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/httpgreet.HelloResponse"}}}},
+			"default": {"description": "Error status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/google.rpc.Status"}}}}
+		}
+	}`
+	require.JSONEq(t, want, get)
+
+	post := jsonAt(t, doc, "paths", "/api/greet/{first_name}", "post", "requestBody")
+	require.JSONEq(t, `{"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/httpgreet.HelloRequest"}}}}`, post)
+	require.Equal(t, "null", jsonAt(t, doc, "paths", "/api/greet/hello", "post", "parameters"))
+
+	schema := jsonAt(t, doc, "components", "schemas", "httpgreet.HelloRequest")
+	want = `{
+		"type": "object",
+		"properties": {
+			"firstName": {"type": "string", "description": "The name to greet."},
+			"lastName": {"type": "string"}
+		}
+	}`
+	require.JSONEq(t, want, schema)
+}
+
+// jsonAt returns the JSON of the value at a path of object keys of v.
+func jsonAt(t *testing.T, v any, path ...string) string {
+	t.Helper()
+	for _, key := range path {
+		obj, ok := v.(map[string]any)
+		require.True(t, ok, "not an object at %s", key)
+		v = obj[key]
+	}
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                                    "/",
+		"/v1/books/{id}":                       "/v1/books/{id}",
+		"/v1/{name=shelves/*/books/*}:publish": "/v1/{name}:publish",
+		"/v1/{book.name=**}":                   "/v1/{book.name}",
+		"/v1/*/books/**":                       "/v1/*/books/**",
+	}
+	for pattern, want := range tests {
+		tmpl, err := parseTemplate(pattern)
+		require.NoError(t, err)
+		require.Equal(t, want, openAPIPath(tmpl), pattern)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := newOpenAPIDoc(nil)
+	md := (&exemplar.SampleResponse{}).ProtoReflect().Descriptor()
+	require.Equal(t, &openAPISchema{Ref: "#/components/schemas/exemplar.SampleResponse"}, doc.messageSchema(md))
+	s := doc.Components.Schemas["exemplar.SampleResponse"]
+	require.NotNil(t, s)
+	require.Equal(t, &openAPISchema{Type: "string", Format: "int64"}, s.Properties["aInt64"])
+	require.Equal(t, &openAPISchema{Type: "string", Format: "byte"}, s.Properties["aBytes"])
+	enum := []string{"SAMPLE_ENUM_UNSPECIFIED", "SAMPLE_ENUM_FIRST", "SAMPLE_ENUM_SECOND"}
+	require.Equal(t, &openAPISchema{Type: "array", Items: &openAPISchema{Type: "string", Enum: enum}}, s.Properties["aEnumList"])
+	require.Equal(t, &openAPISchema{Type: "object", AdditionalProperties: &openAPISchema{Type: "boolean"}}, s.Properties["aMap"])
+	require.Equal(t, &openAPISchema{Ref: "#/components/schemas/exemplar.SampleResponse"}, s.Properties["recursive"])
+	require.Contains(t, doc.Components.Schemas, "exemplar.SampleResponse.SampleMessage1")
+
+	md = (&exemplar.WellKnownSample{}).ProtoReflect().Descriptor()
+	doc.messageSchema(md)
+	s = doc.Components.Schemas["exemplar.WellKnownSample"]
+	require.Equal(t, &openAPISchema{Type: "string", Format: "date-time"}, s.Properties["timestamp"])
+	require.Equal(t, &openAPISchema{Type: "string", Format: "int64"}, s.Properties["int64Value"])
+	require.NotContains(t, doc.Components.Schemas, "google.protobuf.Timestamp")
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	h, err := NewHandler(newCommentedFiles(t), nil, WithOpenAPI(""))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultOpenAPIPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ContentTypeJSON, w.Header().Get("Content-Type"))
+	want, err := h.OpenAPI()
+	require.NoError(t, err)
+	require.Equal(t, string(want), w.Body.String())
+}
+
+func TestOpenAPIWellKnownQueryParams(t *testing.T) {
+	doc := newOpenAPIDoc(nil)
+	md := (&exemplar.WellKnownSample{}).ProtoReflect().Descriptor()
+	op := &openAPIOperation{}
+	doc.queryParameters(op, md, "", "", "", nil, map[protoreflect.FullName]bool{})
+	params := map[string]*openAPISchema{}
+	for _, p := range op.Parameters {
+		params[p.Name] = p.Schema
+	}
+	require.Equal(t, &openAPISchema{Type: "string", Format: "date-time"}, params["timestamp"])
+	require.Equal(t, &openAPISchema{Type: "string", Format: "int64"}, params["int64Value"])
+	for _, name := range []string{"any", "empty", "listValue", "struct", "value"} {
+		require.NotContains(t, params, name)
+	}
+
+	// The advertised parameters decode from their JSON scalar forms.
+	rule := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/samples"}}
+	query := "timestamp=2024-01-02T03:04:05Z&duration=1.5s&int64Value=42&boolValue=true" +
+		"&bytesValue=aGk%3D&stringValue=fox&fieldMask=a.b,c"
+	req := httptest.NewRequest("GET", "/v1/samples?"+query, nil)
+	actual := &exemplar.WellKnownSample{}
+	require.NoError(t, DecodeRequest(rule, map[string]string{}, req, actual))
+	expected := &exemplar.WellKnownSample{
+		Timestamp:   timestamppb.New(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+		Duration:    durationpb.New(1500 * time.Millisecond),
+		Int64Value:  wrapperspb.Int64(42),
+		BoolValue:   wrapperspb.Bool(true),
+		BytesValue:  wrapperspb.Bytes([]byte("hi")),
+		StringValue: wrapperspb.String("fox"),
+		FieldMask:   &fieldmaskpb.FieldMask{Paths: []string{"a.b", "c"}},
+	}
+	require.Truef(t, proto.Equal(expected, actual), "expected: %s,\nactual: %s", expected, actual)
+
+	req = httptest.NewRequest("GET", "/v1/samples?timestamp=yesterday", nil)
+	err := DecodeRequest(rule, map[string]string{}, req, &exemplar.WellKnownSample{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,176 @@
+package httprule
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests to httpMethods by their path templates using a
+// trie of path segments. When several templates match a path, literal
+// segments take precedence over "*" segments, which take precedence over
+// "**" segments, comparing segments from left to right.
+type router struct {
+	root routeNode
+}
+
+type routeNode struct {
+	literals map[string]*routeNode
+	wildcard *routeNode
+	// routes are the methods of templates ending at this node and multi
+	// those of templates ending with a "**" segment at this node.
+	routes verbRoutes
+	multi  verbRoutes
+}
+
+// verbRoutes holds methods by template verb, then by HTTP method.
+type verbRoutes map[string]map[string]*httpMethod
+
+// add adds m to the router, returning an error if another method is
+// already bound to the same template and HTTP method.
+func (r *router) add(m *httpMethod) error {
+	n := &r.root
+	routes := &n.routes
+	for _, seg := range m.tmpl.segments {
+		switch seg.kind {
+		case literalSegment:
+			if n.literals == nil {
+				n.literals = map[string]*routeNode{}
+			}
+			if n.literals[seg.literal] == nil {
+				n.literals[seg.literal] = &routeNode{}
+			}
+			n = n.literals[seg.literal]
+		case wildcardSegment:
+			if n.wildcard == nil {
+				n.wildcard = &routeNode{}
+			}
+			n = n.wildcard
+		case multiSegment:
+			// "**" is always the last segment.
+			routes = &n.multi
+			continue
+		}
+		routes = &n.routes
+	}
+	if *routes == nil {
+		*routes = verbRoutes{}
+	}
+	byMethod := (*routes)[m.tmpl.verb]
+	if byMethod == nil {
+		byMethod = map[string]*httpMethod{}
+		(*routes)[m.tmpl.verb] = byMethod
+	}
+	if other := byMethod[m.httpMethod]; other != nil {
+		_, pattern := extractSelect(m.rule)
+		_, otherPattern := extractSelect(other.rule)
+		return fmt.Errorf("conflicting HttpRules: %s %s of %s and %s %s of %s",
+			m.httpMethod, pattern, m.desc.FullName(), other.httpMethod, otherPattern, other.desc.FullName())
+	}
+	byMethod[m.httpMethod] = m
+	return nil
+}
+
+// match finds the method with the highest precedence template matching the
+// escaped URL path that is accepted by the accept function. It returns the
+// method with its path vars, or nil if there is none. allowed holds the HTTP
+// methods of the highest precedence template matching the path, so it is
+// not empty if the path matches but no method is accepted.
+func (r *router) match(path string, accept func(*httpMethod) bool) (m *httpMethod, vars map[string]string, allowed []string) {
+	path, ok := strings.CutPrefix(path, "/")
+	if !ok {
+		return nil, nil, nil
+	}
+	visit := func(byMethod map[string]*httpMethod) bool {
+		if len(byMethod) == 0 {
+			return false
+		}
+		if allowed == nil {
+			for method := range byMethod {
+				allowed = append(allowed, method)
+			}
+			sort.Strings(allowed)
+		}
+		for _, candidate := range sortedMethods(byMethod) {
+			if !accept(candidate) {
+				continue
+			}
+			if vars = candidate.tmpl.match("/" + path); vars != nil {
+				m = candidate
+				return true
+			}
+		}
+		return false
+	}
+	// A custom verb follows the last ":" of the last segment. Paths with a
+	// verb are matched against templates with that verb first, and then as
+	// a whole against templates without a verb.
+	if i := strings.LastIndexByte(path, ':'); i >= 0 && !strings.Contains(path[i:], "/") {
+		if r.root.match(split(path[:i]), path[i+1:], visit) {
+			return m, vars, allowed
+		}
+	}
+	if r.root.match(split(path), "", visit) {
+		return m, vars, allowed
+	}
+	return nil, nil, allowed
+}
+
+// methods returns the sorted HTTP methods of all templates matching the
+// escaped URL path.
+func (r *router) methods(path string) []string {
+	var methods []string
+	r.match(path, func(m *httpMethod) bool {
+		if !slices.Contains(methods, m.httpMethod) && m.tmpl.match(path) != nil {
+			methods = append(methods, m.httpMethod)
+		}
+		return false
+	})
+	sort.Strings(methods)
+	return methods
+}
+
+// match walks the trie in precedence order, calling visit with the methods
+// of every template matching parts and verb until visit returns true.
+func (n *routeNode) match(parts []string, verb string, visit func(map[string]*httpMethod) bool) bool {
+	if len(parts) == 0 {
+		if visit(n.routes[verb]) {
+			return true
+		}
+	} else {
+		if lit, err := unescape(parts[0], false); err == nil {
+			if child := n.literals[lit]; child != nil && child.match(parts[1:], verb, visit) {
+				return true
+			}
+		}
+		if n.wildcard != nil && parts[0] != "" {
+			if n.wildcard.match(parts[1:], verb, visit) {
+				return true
+			}
+		}
+	}
+	return visit(n.multi[verb])
+}
+
+func split(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// sortedMethods returns the methods of byMethod ordered by HTTP method, so
+// that matching is deterministic.
+func sortedMethods(byMethod map[string]*httpMethod) []*httpMethod {
+	keys := make([]string, 0, len(byMethod))
+	for k := range byMethod {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	methods := make([]*httpMethod, len(keys))
+	for i, k := range keys {
+		methods[i] = byMethod[k]
+	}
+	return methods
+}
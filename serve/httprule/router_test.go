@@ -0,0 +1,133 @@
+package httprule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+
+	"foxygo.at/jig/pb/httpgreet"
+)
+
+func newTestMethod(t *testing.T, rule *annotations.HttpRule) *httpMethod {
+	t.Helper()
+	md := httpgreet.File_httpgreet_httpgreet_proto.Services().Get(0).Methods().Get(0)
+	method, pattern := extractSelect(rule)
+	tmpl, err := parseTemplate(pattern)
+	require.NoError(t, err)
+	return &httpMethod{desc: md, rule: rule, httpMethod: method, tmpl: tmpl}
+}
+
+func newTestRouter(t *testing.T, rules ...*annotations.HttpRule) *router {
+	t.Helper()
+	r := &router{}
+	for _, rule := range rules {
+		require.NoError(t, r.add(newTestMethod(t, rule)))
+	}
+	return r
+}
+
+func getRule(path string) *annotations.HttpRule {
+	return &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: path}}
+}
+
+func postRule(path string) *annotations.HttpRule {
+	return &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: path}}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	r := newTestRouter(t,
+		getRule("/v1/{name=**}"),
+		getRule("/v1/books/{id}"),
+		getRule("/v1/books/special"),
+		getRule("/v1/{collection}/{id}"),
+		getRule("/v1/books/{id}:publish"),
+		postRule("/v1/books/special"),
+		getRule("/v1/books/{id=**}"),
+	)
+	tests := []struct {
+		path    string
+		pattern string
+		vars    map[string]string
+	}{
+		{"/v1/books/special", "/v1/books/special", map[string]string{}},
+		{"/v1/books/1", "/v1/books/{id}", map[string]string{"id": "1"}},
+		{"/v1/shelves/1", "/v1/{collection}/{id}", map[string]string{"collection": "shelves", "id": "1"}},
+		{"/v1/books/1/pages/2", "/v1/books/{id=**}", map[string]string{"id": "1/pages/2"}},
+		{"/v1/shelves/1/books/2", "/v1/{name=**}", map[string]string{"name": "shelves/1/books/2"}},
+		{"/v1", "/v1/{name=**}", map[string]string{"name": ""}},
+		{"/v1/books/1:publish", "/v1/books/{id}:publish", map[string]string{"id": "1"}},
+		{"/v1/books/1:other", "/v1/books/{id}", map[string]string{"id": "1:other"}},
+		{"/v1/book%73/special", "/v1/books/special", map[string]string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			m, vars, _ := r.match(tc.path, func(m *httpMethod) bool { return m.httpMethod == "GET" })
+			require.NotNil(t, m)
+			_, pattern := extractSelect(m.rule)
+			require.Equal(t, tc.pattern, pattern)
+			require.Equal(t, tc.vars, vars)
+		})
+	}
+
+	m, _, _ := r.match("/v2/books", func(*httpMethod) bool { return true })
+	require.Nil(t, m)
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	r := newTestRouter(t,
+		getRule("/v1/books/{id}"),
+		postRule("/v1/books/special"),
+		&annotations.HttpRule{Pattern: &annotations.HttpRule_Delete{Delete: "/v1/books/special"}},
+	)
+	isMethod := func(method string) func(*httpMethod) bool {
+		return func(m *httpMethod) bool { return m.httpMethod == method }
+	}
+
+	// A less specific template matches if the more specific one does not
+	// handle the HTTP method.
+	m, vars, _ := r.match("/v1/books/special", isMethod("GET"))
+	require.NotNil(t, m)
+	require.Equal(t, map[string]string{"id": "special"}, vars)
+
+	m, _, allowed := r.match("/v1/books/special", isMethod("PUT"))
+	require.Nil(t, m)
+	require.Equal(t, []string{"DELETE", "POST"}, allowed)
+
+	m, _, allowed = r.match("/v1/books/1", isMethod("POST"))
+	require.Nil(t, m)
+	require.Equal(t, []string{"GET"}, allowed)
+
+	_, _, allowed = r.match("/v1/shelves", isMethod("GET"))
+	require.Empty(t, allowed)
+}
+
+func TestRouterConflicts(t *testing.T) {
+	add := func(r *router, rule *annotations.HttpRule) error {
+		return r.add(newTestMethod(t, rule))
+	}
+	conflicts := [][2]*annotations.HttpRule{
+		{getRule("/v1/books"), getRule("/v1/books")},
+		{getRule("/v1/books/{id}"), getRule("/v1/books/{name}")},
+		{getRule("/v1/{name=books/*}"), getRule("/v1/books/{id}")},
+		{getRule("/v1/{name=**}"), getRule("/v1/**")},
+		{getRule("/v1/books:list"), getRule("/v1/books:list")},
+	}
+	for _, rules := range conflicts {
+		r := &router{}
+		require.NoError(t, add(r, rules[0]))
+		require.ErrorContains(t, add(r, rules[1]), "conflicting HttpRules")
+	}
+	compatible := []*annotations.HttpRule{
+		getRule("/v1/books"),
+		postRule("/v1/books"),
+		getRule("/v1/books:list"),
+		getRule("/v1/books/{id}"),
+		getRule("/v1/books/{id=**}"),
+		getRule("/v1/{name=**}"),
+	}
+	r := &router{}
+	for _, rule := range compatible {
+		require.NoError(t, add(r, rule))
+	}
+}
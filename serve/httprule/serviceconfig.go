@@ -0,0 +1,111 @@
+package httprule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// WithServiceConfig is an [Option] to configure a [Handler] with the HTTP
+// rules of a gRPC API service config YAML file, the google.api.Service
+// "http" section:
+//
+//	type: google.api.Service
+//	config_version: 3
+//	http:
+//	  rules:
+//	  - selector: example.v1.Messaging.GetMessage
+//	    get: /v1/{name=messages/*}
+//	  - selector: example.v1.Admin.*
+//	    post: /admin/{method}
+//	    body: "*"
+//
+// Each rule applies to the methods matching its selector: a fully
+// qualified method name, or a name ending in ".*" or "*" alone to match
+// all methods under a package or service. Rules follow "last one wins"
+// order: only the last rule matching a method applies to it, and it takes
+// precedence over the method's HttpRule annotations. As with [WithRuleTemplates],
+// {package}, {service} and {method} in rule paths are replaced with the
+// names of the method. The option can be given several times to load
+// several service configs.
+func WithServiceConfig(path string) Option {
+	return func(h *Handler) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rules, err := parseServiceConfig(b)
+		if err != nil {
+			return fmt.Errorf("service config %s: %w", path, err)
+		}
+		h.configRules = append(h.configRules, rules...)
+		return nil
+	}
+}
+
+// parseServiceConfig returns the HTTP rules of a service config YAML file.
+// Other sections of the service config are ignored.
+func parseServiceConfig(b []byte) ([]*annotations.HttpRule, error) {
+	b, err := yamlToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		HTTP json.RawMessage `json:"http"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	if config.HTTP == nil {
+		return nil, nil
+	}
+	httpConfig := &annotations.Http{}
+	if err := protojson.Unmarshal(config.HTTP, httpConfig); err != nil {
+		return nil, fmt.Errorf("http: %w", err)
+	}
+	for i, rule := range httpConfig.Rules {
+		if err := validateSelector(rule.Selector); err != nil {
+			return nil, fmt.Errorf("http rule %d: %w", i, err)
+		}
+	}
+	return httpConfig.Rules, nil
+}
+
+func validateSelector(selector string) error {
+	if selector == "" {
+		return errors.New("no selector")
+	}
+	if i := strings.IndexByte(selector, '*'); i >= 0 && (selector[i:] != "*" || (i > 0 && selector[i-1] != '.')) {
+		return fmt.Errorf("invalid selector %q: wildcards must be the last name of the selector", selector)
+	}
+	return nil
+}
+
+// selectRules returns a copy of the last rule whose selector matches
+// method, as service config rules follow "last one wins" order, with
+// {package}, {service} and {method} interpolated. It returns no rules if
+// no selector matches.
+func selectRules(rules []*annotations.HttpRule, md protoreflect.MethodDescriptor) []*annotations.HttpRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if selectorMatches(rules[i].Selector, md.FullName()) {
+			sd := md.Parent().(protoreflect.ServiceDescriptor)
+			return interpolateHTTPRules(rules[i:i+1], string(md.ParentFile().Package()), string(sd.Name()), string(md.Name()))
+		}
+	}
+	return nil
+}
+
+// selectorMatches returns true if selector is name, or a wildcard selector
+// matching it.
+func selectorMatches(selector string, name protoreflect.FullName) bool {
+	if prefix, ok := strings.CutSuffix(selector, "*"); ok {
+		return strings.HasPrefix(string(name), prefix)
+	}
+	return selector == string(name)
+}
@@ -0,0 +1,152 @@
+package httprule
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/httpgreet"
+	"foxygo.at/jig/serve"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+	b, err := os.ReadFile("testdata/httpgreet/service.yaml")
+	require.NoError(t, err)
+	rules, err := parseServiceConfig(b)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "httpgreet.HttpGreeter.*", rules[0].Selector)
+	require.Equal(t, "/v1/{method}", rules[0].GetGet())
+	require.Equal(t, "httpgreet.HttpGreeter.PostHello", rules[1].Selector)
+	require.Equal(t, "/v1/hello", rules[1].GetPost())
+	require.Equal(t, "*", rules[1].Body)
+	require.Len(t, rules[1].AdditionalBindings, 1)
+	require.Equal(t, "/v1/{method}/{first_name}", rules[1].AdditionalBindings[0].GetPost())
+
+	rules, err = parseServiceConfig([]byte("type: google.api.Service\nname: example.com\n"))
+	require.NoError(t, err)
+	require.Empty(t, rules)
+
+	tests := map[string]string{
+		"no selector":     "http:\n  rules:\n  - get: /v1/hello\n",
+		"inner wildcard":  "http:\n  rules:\n  - selector: pkg.*.Method\n    get: /v1/hello\n",
+		"partial name":    "http:\n  rules:\n  - selector: pkg.Svc.Get*\n    get: /v1/hello\n",
+		"unknown field":   "http:\n  rules:\n  - selector: pkg.Svc.Get\n    fetch: /v1/hello\n",
+		"invalid yaml":    "http: [",
+		"not a rule list": "http:\n  rules: /v1/hello\n",
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseServiceConfig([]byte(config))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSelectRules(t *testing.T) {
+	md := httpgreet.File_httpgreet_httpgreet_proto.Services().ByName("HttpGreeter").Methods().ByName("PostHello")
+
+	rule := func(selector, path string) *annotations.HttpRule {
+		return &annotations.HttpRule{Selector: selector, Pattern: &annotations.HttpRule_Get{Get: path}}
+	}
+	paths := func(rules []*annotations.HttpRule) []string {
+		var result []string
+		for _, r := range rules {
+			result = append(result, r.GetGet())
+		}
+		return result
+	}
+	tests := map[string]struct {
+		rules []*annotations.HttpRule
+		want  []string
+	}{
+		"exact": {
+			rules: []*annotations.HttpRule{rule("httpgreet.HttpGreeter.GetHello", "/get"), rule("httpgreet.HttpGreeter.PostHello", "/exact")},
+			want:  []string{"/exact"},
+		},
+		"prefix": {
+			rules: []*annotations.HttpRule{rule("other.*", "/other"), rule("httpgreet.HttpGreeter.*", "/{service}/{method}")},
+			want:  []string{"/HttpGreeter/PostHello"},
+		},
+		"all": {
+			rules: []*annotations.HttpRule{rule("*", "/{package}/{method}"), rule("other.*", "/other")},
+			want:  []string{"/httpgreet/PostHello"},
+		},
+		"last wins": {
+			rules: []*annotations.HttpRule{rule("httpgreet.HttpGreeter.PostHello", "/exact"), rule("httpgreet.*", "/pkg"), rule("other.*", "/other")},
+			want:  []string{"/pkg"},
+		},
+		"same selector": {
+			rules: []*annotations.HttpRule{rule("httpgreet.*", "/a"), rule("httpgreet.*", "/b")},
+			want:  []string{"/b"},
+		},
+		"no match": {
+			rules: []*annotations.HttpRule{rule("httpgreet.HttpGreeter.GetHello", "/get"), rule("httpgreet.Other.*", "/other")},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, paths(selectRules(tc.rules, md)))
+		})
+	}
+	// Selected rules are interpolated copies.
+	rules := []*annotations.HttpRule{rule("*", "/{method}")}
+	selectRules(rules, md)
+	require.Equal(t, "/{method}", rules[0].GetGet())
+}
+
+func TestHTTPRuleServiceConfig(t *testing.T) {
+	ts := serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("testdata/httpgreet"), serve.WithLogger(log.DiscardLogger), withHTTPRuleHandler(WithServiceConfig("testdata/httpgreet/service.yaml")))
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://jig"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := ts.HTTPClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(raw)
+	}
+
+	status, body := do("GET", "/v1/SimpleHello?first_name=fox", "")
+	require.Equal(t, http.StatusOK, status, body)
+	require.JSONEq(t, `{"greeting": "Simply, hello, fox"}`, body)
+
+	status, body = do("GET", "/v1/GetHello?first_name=fox", "")
+	require.Equal(t, http.StatusOK, status, body)
+	require.JSONEq(t, `{"greeting": "httpgreet: Hello, fox"}`, body)
+
+	status, body = do("POST", "/v1/hello", `{"first_name": "fox"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	require.JSONEq(t, `{"greeting": "Thanks for the post, fox"}`, body)
+
+	status, body = do("POST", "/v1/PostHello/fox", `{}`)
+	require.Equal(t, http.StatusOK, status, body)
+	require.JSONEq(t, `{"greeting": "Thanks for the post, fox"}`, body)
+
+	// Service config rules replace the HttpRule annotations of the methods
+	// they select, and less specific rules do not apply.
+	status, _ = do("GET", "/api/greet/hello/fox", "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = do("GET", "/v1/PostHello", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestWithServiceConfigError(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewHandler(nil, nil, WithServiceConfig(filepath.Join(dir, "missing.yaml")))
+	require.Error(t, err)
+
+	path := filepath.Join(dir, "service.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("http:\n  rules:\n  - get: /v1/hello\n"), 0o600))
+	_, err = NewHandler(nil, nil, WithServiceConfig(path))
+	require.ErrorContains(t, err, "service config "+path)
+}
@@ -0,0 +1,302 @@
+package httprule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// pathTemplate is a parsed google.api.http path template:
+//
+//	Template = "/" Segments [ Verb ] ;
+//	Segments = Segment { "/" Segment } ;
+//	Segment  = "*" | "**" | LITERAL | Variable ;
+//	Variable = "{" FieldPath [ "=" Segments ] "}" ;
+//	FieldPath = IDENT { "." IDENT } ;
+//	Verb     = ":" LITERAL ;
+//
+// A variable without segments, e.g. {name}, is equivalent to {name=*}. A
+// "**" segment matches zero or more path segments and must be the last
+// segment of the template.
+type pathTemplate struct {
+	segments  []segment
+	variables []variable
+	verb      string
+}
+
+type segmentKind int
+
+const (
+	literalSegment  segmentKind = iota
+	wildcardSegment             // "*": exactly one segment
+	multiSegment                // "**": zero or more segments
+)
+
+type segment struct {
+	kind    segmentKind
+	literal string
+}
+
+// variable binds the path segments [start, end) of a template to a field
+// path. end is -1 if the variable ends with a "**" segment.
+type variable struct {
+	fieldPath  string
+	start, end int
+}
+
+// parseTemplate parses a path template, returning an error if it does not
+// follow the HttpRule grammar.
+func parseTemplate(tmpl string) (*pathTemplate, error) {
+	p := &templateParser{input: tmpl}
+	t, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template %q: %w", tmpl, err)
+	}
+	return t, nil
+}
+
+type templateParser struct {
+	input string
+	pos   int
+	t     pathTemplate
+}
+
+func (p *templateParser) parse() (*pathTemplate, error) {
+	if !p.consume('/') {
+		return nil, errors.New("must start with /")
+	}
+	if p.pos == len(p.input) {
+		// The root path "/" has no segments.
+		return &p.t, nil
+	}
+	if err := p.parseSegments(false); err != nil {
+		return nil, err
+	}
+	if p.consume(':') {
+		p.t.verb = p.literal()
+		if p.t.verb == "" {
+			return nil, errors.New("empty verb")
+		}
+	}
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.input[p.pos], p.pos)
+	}
+	for i, seg := range p.t.segments {
+		if seg.kind == multiSegment && i != len(p.t.segments)-1 {
+			return nil, errors.New("** must be the last segment")
+		}
+	}
+	return &p.t, nil
+}
+
+func (p *templateParser) parseSegments(inVariable bool) error {
+	for {
+		if err := p.parseSegment(inVariable); err != nil {
+			return err
+		}
+		if !p.consume('/') {
+			return nil
+		}
+	}
+}
+
+func (p *templateParser) parseSegment(inVariable bool) error {
+	switch {
+	case strings.HasPrefix(p.input[p.pos:], "**"):
+		p.pos += 2
+		p.t.segments = append(p.t.segments, segment{kind: multiSegment})
+	case p.consume('*'):
+		p.t.segments = append(p.t.segments, segment{kind: wildcardSegment})
+	case p.consume('{'):
+		if inVariable {
+			return errors.New("nested variable")
+		}
+		return p.parseVariable()
+	default:
+		lit := p.literal()
+		if lit == "" {
+			return fmt.Errorf("empty segment at offset %d", p.pos)
+		}
+		p.t.segments = append(p.t.segments, segment{kind: literalSegment, literal: lit})
+	}
+	return nil
+}
+
+func (p *templateParser) parseVariable() error {
+	start := p.pos
+	for p.pos < len(p.input) && isFieldPathChar(p.input[p.pos]) {
+		p.pos++
+	}
+	fieldPath := p.input[start:p.pos]
+	if !isFieldPath(fieldPath) {
+		return fmt.Errorf("invalid field path %q", fieldPath)
+	}
+	for _, v := range p.t.variables {
+		if v.fieldPath == fieldPath {
+			return fmt.Errorf("duplicate variable %q", fieldPath)
+		}
+	}
+	v := variable{fieldPath: fieldPath, start: len(p.t.segments)}
+	if p.consume('=') {
+		if err := p.parseSegments(true); err != nil {
+			return err
+		}
+	} else {
+		p.t.segments = append(p.t.segments, segment{kind: wildcardSegment})
+	}
+	if !p.consume('}') {
+		return fmt.Errorf("unterminated variable %q", fieldPath)
+	}
+	v.end = len(p.t.segments)
+	if p.t.segments[v.end-1].kind == multiSegment {
+		v.end = -1
+	}
+	p.t.variables = append(p.t.variables, v)
+	return nil
+}
+
+// literal consumes and returns a LITERAL, which runs up to the next
+// character with a meaning in the template grammar.
+func (p *templateParser) literal() string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune("/{}=*:", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *templateParser) consume(c byte) bool {
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func isFieldPathChar(c byte) bool {
+	return c == '.' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isFieldPath(s string) bool {
+	for _, ident := range strings.Split(s, ".") {
+		if ident == "" || ('0' <= ident[0] && ident[0] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// match matches an escaped URL path, as returned by url.URL.EscapedPath,
+// against the template. It returns the values of the template's variables,
+// keyed by field path, or nil if the path does not match.
+//
+// Literal segments and single segment variables match the unescaped path
+// segment. Multi segment variables are unescaped except for "%2F", so their
+// segments can still be told apart.
+func (t *pathTemplate) match(path string) map[string]string {
+	parts, ok := t.split(path)
+	if !ok {
+		return nil
+	}
+	if !t.matchSegments(parts) {
+		return nil
+	}
+	vars := make(map[string]string, len(t.variables))
+	for _, v := range t.variables {
+		end := v.end
+		if end == -1 {
+			end = len(parts)
+		}
+		var value string
+		var err error
+		if end-v.start == 1 && t.segments[v.start].kind != multiSegment {
+			value, err = unescape(parts[v.start], false)
+		} else {
+			value, err = unescape(strings.Join(parts[v.start:end], "/"), true)
+		}
+		if err != nil {
+			return nil
+		}
+		vars[v.fieldPath] = value
+	}
+	return vars
+}
+
+// split removes the verb from path and splits it into its escaped segments.
+func (t *pathTemplate) split(path string) ([]string, bool) {
+	path, ok := strings.CutPrefix(path, "/")
+	if !ok {
+		return nil, false
+	}
+	if t.verb != "" {
+		if path, ok = strings.CutSuffix(path, ":"+t.verb); !ok {
+			return nil, false
+		}
+	}
+	if path == "" {
+		return nil, true
+	}
+	return strings.Split(path, "/"), true
+}
+
+func (t *pathTemplate) matchSegments(parts []string) bool {
+	for i, seg := range t.segments {
+		switch seg.kind {
+		case multiSegment:
+			return true
+		case wildcardSegment:
+			if i >= len(parts) || parts[i] == "" {
+				return false
+			}
+		case literalSegment:
+			if i >= len(parts) {
+				return false
+			}
+			if lit, err := unescape(parts[i], false); err != nil || lit != seg.literal {
+				return false
+			}
+		}
+	}
+	return len(parts) == len(t.segments)
+}
+
+// unescape decodes the percent-encoded characters of s. If keepSlash is
+// true, "%2F" and "%2f" are left as they are.
+func unescape(s string, keepSlash bool) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return "", fmt.Errorf("invalid escape %q", s[i:min(i+3, len(s))])
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if c == '/' && keepSlash {
+			b.WriteString(s[i : i+3])
+		} else {
+			b.WriteByte(c)
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
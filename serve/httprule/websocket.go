@@ -0,0 +1,219 @@
+package httprule
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/serve"
+	"golang.org/x/net/websocket"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// isWebSocketUpgrade returns true if r is a WebSocket opening handshake.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// matchWebSocket returns the streaming method and its path vars whose rule
+// path matches a WebSocket request. The HTTP method of the rule is ignored,
+// as WebSocket handshakes are always GET requests.
+func (h *Handler) matchWebSocket(r *http.Request) (*httpMethod, map[string]string) {
+	isStreaming := func(m *httpMethod) bool {
+		return m.desc.IsStreamingClient() || m.desc.IsStreamingServer()
+	}
+	method, vars, _ := h.router.match(r.URL.EscapedPath(), isStreaming)
+	return method, vars
+}
+
+// serveWebSocket serves a streaming method over a WebSocket connection. Each
+// WebSocket message carries one protobuf message in either direction: text
+// messages are JSON encoded and binary messages are binary encoded.
+// Responses are sent as binary messages if the handshake request accepts
+// application/x-protobuf, and as JSON text messages otherwise.
+//
+// The client ends the request stream by sending an empty message or by
+// closing the connection. If the method fails, a final
+// {"error": status} JSON text message is sent before the connection is
+// closed.
+func (h *Handler) serveWebSocket(m *httpMethod, vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	binary := false
+	if accept, err := getAcceptType(r, true, true); err == nil {
+		binary = accept == ContentTypeBinaryProto
+	}
+	wss := websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			if !h.allowsWebSocketOrigin(r) {
+				return errors.New("origin not allowed")
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			ss := &wsStream{
+				conn:      conn,
+				req:       r,
+				rule:      m.rule,
+				vars:      vars,
+				binary:    binary,
+				log:       h.log,
+				md:        h.incomingMetadata(r),
+				marshaler: h.marshaler,
+			}
+			err := h.grpcHandler(m.desc.FullName(), ss)
+			ss.close(err)
+		},
+	}
+	wss.ServeHTTP(w, r)
+}
+
+// allowsWebSocketOrigin returns true if the Origin of a WebSocket handshake
+// is allowed. Browsers do not apply CORS to WebSockets, so cross-origin
+// handshakes are only accepted from the origins allowed by the CORS
+// configuration of the handler, as other cross-origin requests are.
+// Handshakes without an Origin, from non-browser clients, and from the
+// origin of the handler itself are always accepted.
+func (h *Handler) allowsWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return h.cors != nil && h.cors.allowsOrigin(origin)
+}
+
+// wsFrame is a WebSocket message with its payload type.
+type wsFrame struct {
+	data   []byte
+	binary bool
+}
+
+var wsFrameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(wsFrame)
+		if f.binary {
+			return f.data, websocket.BinaryFrame, nil
+		}
+		return f.data, websocket.TextFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*wsFrame)
+		f.data = data
+		f.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// wsStream is a grpc.ServerStream over a WebSocket connection.
+type wsStream struct {
+	conn   *websocket.Conn
+	req    *http.Request
+	rule   *annotations.HttpRule
+	vars   map[string]string
+	binary bool
+	log    log.Logger
+	md     metadata.MD
+	done   bool
+
+	marshaler marshaler
+}
+
+var _ grpc.ServerStream = &wsStream{}
+
+// SetHeader, SendHeader and SetTrailer discard the metadata, as there are
+// no HTTP headers or trailers once a WebSocket connection is established.
+func (s *wsStream) SetHeader(metadata.MD) error  { return nil }
+func (s *wsStream) SendHeader(metadata.MD) error { return nil }
+func (s *wsStream) SetTrailer(metadata.MD)       {}
+
+// HTTPRequest implements serve.HTTPStream with the WebSocket handshake
+// request.
+func (s *wsStream) HTTPRequest() *serve.HTTPRequest {
+	return newHTTPRequest(s.req, s.vars)
+}
+
+// SetHTTPResponse implements serve.HTTPStream. It has no effect, as the
+// HTTP response of the handshake has already been sent.
+func (s *wsStream) SetHTTPResponse(*serve.HTTPResponse) {}
+
+func (s *wsStream) Context() context.Context {
+	return metadata.NewIncomingContext(s.req.Context(), s.md)
+}
+
+func (s *wsStream) SendMsg(m interface{}) error {
+	mediaType := ContentTypeJSON
+	if s.binary {
+		mediaType = ContentTypeBinaryProto
+	}
+	b, err := s.marshaler.marshalResponse(s.rule.ResponseBody, mediaType, m.(proto.Message))
+	if err != nil {
+		return err
+	}
+	return wsFrameCodec.Send(s.conn, wsFrame{data: b, binary: s.binary})
+}
+
+// cancelRecv unblocks a pending RecvMsg by expiring the read deadline of
+// the connection.
+func (s *wsStream) cancelRecv() {
+	if err := s.conn.SetReadDeadline(time.Now()); err != nil {
+		s.log.Debugf("cannot cancel reading request: %v", err)
+	}
+}
+
+func (s *wsStream) RecvMsg(m interface{}) error {
+	if s.done {
+		return io.EOF
+	}
+	var f wsFrame
+	if err := wsFrameCodec.Receive(s.conn, &f); err != nil {
+		return err
+	}
+	if len(f.data) == 0 {
+		// An empty message half-closes the request stream.
+		s.done = true
+		return io.EOF
+	}
+	target := m.(proto.Message)
+	mediaType := ContentTypeJSON
+	if f.binary {
+		mediaType = ContentTypeBinaryProto
+	}
+	// Each frame is a request message, or its body field if the rule
+	// names one.
+	body := s.rule.Body
+	if body == "" {
+		body = "*"
+	}
+	if err := unmarshalBody(body, mediaType, f.data, target); err != nil {
+		return err
+	}
+	return setURLVars(s.rule, s.vars, s.req, target)
+}
+
+func (s *wsStream) close(err error) {
+	if err != nil {
+		st, merr := protojson.Marshal(status.Convert(err).Proto())
+		if merr != nil {
+			s.log.Errorf("failed to marshal websocket error: %v", merr)
+		} else {
+			frame := wsFrame{data: []byte(`{"error":` + string(st) + `}`)}
+			if serr := wsFrameCodec.Send(s.conn, frame); serr != nil {
+				s.log.Errorf("failed to send websocket error: %v", serr)
+			}
+		}
+	}
+	if err := s.conn.Close(); err != nil {
+		s.log.Debugf("failed to close websocket: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package serve
+
+import (
+	"encoding/json"
+	"path"
+	"sync"
+	"time"
+
+	"foxygo.at/protog/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultJournalSize is the number of calls kept in a Server's Journal
+// unless configured otherwise with WithJournalSize.
+const DefaultJournalSize = 1000
+
+// Call is a record of a method call handled by a Server.
+type Call struct {
+	// Method is the fully qualified method name (pkg.service.method).
+	Method string `json:"method"`
+	// Session is the value of the SessionHeader of the call, if any.
+	Session string `json:"session,omitempty"`
+	// Header is the request metadata of the call.
+	Header metadata.MD `json:"header"`
+	// Requests are the request messages received, encoded as JSON. It has
+	// one element for unary and server-streaming calls.
+	Requests []json.RawMessage `json:"requests"`
+	// Code and Message are the status the call completed with.
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message,omitempty"`
+	// Start is when the call started and Duration how long it took.
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// CallFilter selects calls from a Journal. Empty fields match any call.
+type CallFilter struct {
+	// Method matches the fully qualified method name. It may be a
+	// path.Match pattern, e.g. "greet.Greeter.*".
+	Method string
+	// Session matches the session ID of a call.
+	Session string
+}
+
+func (f CallFilter) match(c *Call) bool {
+	if f.Method != "" {
+		if ok, _ := path.Match(f.Method, c.Method); !ok {
+			return false
+		}
+	}
+	return f.Session == "" || f.Session == c.Session
+}
+
+// Journal is a bounded record of the calls handled by a Server, oldest
+// first. Once full, the oldest calls are dropped to make room for new ones.
+// Journal is safe for concurrent use.
+type Journal struct {
+	mu    sync.Mutex
+	size  int
+	calls []*Call
+}
+
+// Calls returns the recorded calls that match the filter, oldest first.
+func (j *Journal) Calls(filter CallFilter) []*Call {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	result := []*Call{}
+	for _, c := range j.calls {
+		if filter.match(c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// Clear removes the recorded calls that match the filter. The zero
+// CallFilter clears all calls.
+func (j *Journal) Clear(filter CallFilter) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	calls := j.calls[:0]
+	for _, c := range j.calls {
+		if !filter.match(c) {
+			calls = append(calls, c)
+		}
+	}
+	clear(j.calls[len(calls):])
+	j.calls = calls
+}
+
+func (j *Journal) record(c *Call) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.size <= 0 {
+		return
+	}
+	if len(j.calls) >= j.size {
+		n := copy(j.calls, j.calls[len(j.calls)-j.size+1:])
+		clear(j.calls[n:])
+		j.calls = j.calls[:n]
+	}
+	j.calls = append(j.calls, c)
+}
+
+// journalStream is a grpc.ServerStream that keeps the received request
+// messages of a call for recording in the Journal.
+type journalStream struct {
+	grpc.ServerStream
+	reg      *registry.Files
+	requests []json.RawMessage
+}
+
+func (js *journalStream) RecvMsg(m interface{}) error {
+	if err := js.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	mo := protojson.MarshalOptions{Resolver: js.reg}
+	b, err := mo.Marshal(m.(proto.Message))
+	if err != nil {
+		b = []byte("null")
+	}
+	js.requests = append(js.requests, b)
+	return nil
+}
+
+func (js *journalStream) call(method string, start time.Time, err error) *Call {
+	mdata, _ := metadata.FromIncomingContext(js.Context())
+	st := status.Convert(err)
+	return &Call{
+		Method:   method,
+		Session:  firstValue(mdata, SessionHeader),
+		Header:   mdata,
+		Requests: js.requests,
+		Code:     st.Code(),
+		Message:  st.Message(),
+		Start:    start,
+		Duration: time.Since(start),
+	}
+}
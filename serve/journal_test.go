@@ -0,0 +1,89 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJournal(t *testing.T) {
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), WithAdminAPI())
+	defer ts.Stop()
+	c := newGreeterClient(t, ts.Addr())
+	defer c.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), SessionHeader, "s1")
+	_, err := c.Hello(ctx, &greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	_, err = c.Hello(context.Background(), &greet.HelloRequest{FirstName: "Bart"})
+	require.Error(t, err)
+	stream, err := c.HelloClientStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&greet.HelloRequest{FirstName: "1"}))
+	require.NoError(t, stream.Send(&greet.HelloRequest{FirstName: "2"}))
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	calls := ts.Journal.Calls(CallFilter{})
+	require.Len(t, calls, 3)
+
+	calls = ts.Journal.Calls(CallFilter{Method: "greet.Greeter.Hello"})
+	require.Len(t, calls, 2)
+	require.Equal(t, "s1", calls[0].Session)
+	require.Equal(t, []string{"s1"}, calls[0].Header.Get(SessionHeader))
+	require.Equal(t, codes.OK, calls[0].Code)
+	require.Len(t, calls[0].Requests, 1)
+	require.JSONEq(t, `{"firstName": "🌏"}`, string(calls[0].Requests[0]))
+	require.Equal(t, codes.InvalidArgument, calls[1].Code)
+	require.Equal(t, "💃 jig [unary]: eat my shorts", calls[1].Message)
+
+	calls = ts.Journal.Calls(CallFilter{Method: "greet.Greeter.*Stream"})
+	require.Len(t, calls, 1)
+	require.Len(t, calls[0].Requests, 2)
+
+	// Admin API
+	req, err := http.NewRequest("GET", "http://"+ts.Addr()+"/_jig/calls?method=greet.Greeter.Hello", nil)
+	require.NoError(t, err)
+	req.Header.Set(SessionHeader, "s1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var got []*Call
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Len(t, got, 1)
+	require.Equal(t, "greet.Greeter.Hello", got[0].Method)
+
+	req, err = http.NewRequest("DELETE", "http://"+ts.Addr()+"/_jig/calls?method=greet.Greeter.Hello", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Len(t, ts.Journal.Calls(CallFilter{}), 1)
+
+	ts.Journal.Clear(CallFilter{})
+	require.Empty(t, ts.Journal.Calls(CallFilter{}))
+}
+
+func TestJournalBounded(t *testing.T) {
+	j := &Journal{size: 2}
+	for _, m := range []string{"a", "b", "c"} {
+		j.record(&Call{Method: m})
+	}
+	calls := j.Calls(CallFilter{})
+	require.Len(t, calls, 2)
+	require.Equal(t, "b", calls[0].Method)
+	require.Equal(t, "c", calls[1].Method)
+
+	j = &Journal{}
+	j.record(&Call{Method: "a"})
+	require.Empty(t, j.Calls(CallFilter{}))
+}
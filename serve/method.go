@@ -1,13 +1,16 @@
 package serve
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
+	"io/fs"
 
 	"foxygo.at/protog/registry"
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -34,7 +37,7 @@ func (s *Server) unaryClientCall(md protoreflect.MethodDescriptor, ss grpc.Serve
 		return err
 	}
 
-	input, err := makeInputJSON(req, mdata, s.Files)
+	input, err := makeInputJSON(req, mdata, httpRequest(ss), s.Files)
 	if err != nil {
 		return err
 	}
@@ -56,7 +59,7 @@ func (s *Server) streamingClientCall(md protoreflect.MethodDescriptor, ss grpc.S
 		stream = append(stream, msg)
 	}
 
-	input, err := makeStreamingInputJSON(stream, mdata, s.Files)
+	input, err := makeStreamingInputJSON(stream, mdata, httpRequest(ss), s.Files)
 	if err != nil {
 		return err
 	}
@@ -77,7 +80,7 @@ func (s *Server) streamingBidiCall(md protoreflect.MethodDescriptor, ss grpc.Ser
 
 		// For bidirectional streaming, we call evaluator once for each message
 		// on the input stream and stream out the results.
-		input, err := makeInputJSON(msg, mdata, s.Files)
+		input, err := makeInputJSON(msg, mdata, httpRequest(ss), s.Files)
 		if err != nil {
 			return err
 		}
@@ -88,8 +91,17 @@ func (s *Server) streamingBidiCall(md protoreflect.MethodDescriptor, ss grpc.Ser
 	return nil
 }
 
+// ScenarioHeader is the request metadata key that selects a scenario for a
+// call. A scenario is a subdirectory of the method directories whose method
+// definitions take precedence over the top level ones for that call only.
+const ScenarioHeader = "x-jig-scenario"
+
 func (s *Server) evaluate(md protoreflect.MethodDescriptor, input string, ss grpc.ServerStream, reg *registry.Files) error {
-	output, err := s.eval.Evaluate(string(md.FullName()), input, s.fs)
+	vfs, err := s.methodFS(ss.Context())
+	if err != nil {
+		return err
+	}
+	output, err := s.eval.Evaluate(string(md.FullName()), input, vfs)
 	if err != nil {
 		return err
 	}
@@ -106,6 +118,14 @@ func (s *Server) evaluate(md protoreflect.MethodDescriptor, input string, ss grp
 	if len(result.trailer) > 0 {
 		ss.SetTrailer(result.trailer)
 	}
+	if result.http != nil {
+		hs, ok := httpStreamOf(ss)
+		if ok {
+			hs.SetHTTPResponse(result.http)
+		} else if result.status == nil && !md.IsStreamingServer() && len(result.stream) == 0 {
+			return status.Error(codes.Internal, "method returned only an HTTP body to a non-HTTP call")
+		}
+	}
 	if result.status != nil {
 		return status.ErrorProto(result.status)
 	}
@@ -117,10 +137,49 @@ func (s *Server) evaluate(md protoreflect.MethodDescriptor, input string, ss grp
 	return nil
 }
 
+// methodFS returns the filesystem to load method definitions from for a
+// call. Runtime overrides for the call's session and for all calls are
+// stacked on top of the method directories. If the call selects a scenario
+// with the ScenarioHeader, the scenario subdirectory is stacked between them,
+// so methods not defined in the scenario fall back to their default
+// definitions.
+func (s *Server) methodFS(ctx context.Context) (fs.FS, error) {
+	mdata, _ := metadata.FromIncomingContext(ctx)
+	var stack stackedFS
+	if session := firstValue(mdata, SessionHeader); session != "" {
+		stack = append(stack, s.Overrides.FS(session))
+	}
+	stack = append(stack, s.Overrides.FS(""))
+	if scenario := firstValue(mdata, ScenarioHeader); scenario != "" {
+		sub, err := fs.Sub(s.fs, scenario)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid scenario %q", scenario)
+		}
+		s.log.Debugf("using scenario %q", scenario)
+		stack = append(stack, sub)
+	}
+	return append(stack, s.fs), nil
+}
+
+func firstValue(mdata metadata.MD, key string) string {
+	if values := mdata.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func httpRequest(ss grpc.ServerStream) *HTTPRequest {
+	if hs, ok := httpStreamOf(ss); ok {
+		return hs.HTTPRequest()
+	}
+	return nil
+}
+
 type request struct {
 	Header  metadata.MD       `json:"header"`
 	Request json.RawMessage   `json:"request,omitempty"`
 	Stream  []json.RawMessage `json:"stream,omitempty"`
+	HTTP    *HTTPRequest      `json:"http,omitempty"`
 }
 
 type response struct {
@@ -129,6 +188,7 @@ type response struct {
 	Response json.RawMessage   `json:"response"`
 	Stream   []json.RawMessage `json:"stream"`
 	Status   json.RawMessage   `json:"status"`
+	HTTP     *HTTPResponse     `json:"http"`
 }
 
 type methodResult struct {
@@ -136,10 +196,11 @@ type methodResult struct {
 	trailer metadata.MD
 	stream  []*dynamicpb.Message
 	status  *statuspb.Status
+	http    *HTTPResponse
 }
 
-func makeInputJSON(msg *dynamicpb.Message, md metadata.MD, reg *registry.Files) (string, error) {
-	v := request{Header: md, Request: []byte("null")}
+func makeInputJSON(msg *dynamicpb.Message, md metadata.MD, httpReq *HTTPRequest, reg *registry.Files) (string, error) {
+	v := request{Header: md, Request: []byte("null"), HTTP: httpReq}
 	if msg != nil {
 		mo := protojson.MarshalOptions{EmitUnpopulated: true, Resolver: reg}
 		b, err := mo.Marshal(msg)
@@ -156,9 +217,9 @@ func makeInputJSON(msg *dynamicpb.Message, md metadata.MD, reg *registry.Files)
 	return string(input), nil
 }
 
-func makeStreamingInputJSON(stream []*dynamicpb.Message, md metadata.MD, reg *registry.Files) (string, error) {
+func makeStreamingInputJSON(stream []*dynamicpb.Message, md metadata.MD, httpReq *HTTPRequest, reg *registry.Files) (string, error) {
 	mo := protojson.MarshalOptions{EmitUnpopulated: true, Resolver: reg}
-	v := request{Header: md, Stream: make([]json.RawMessage, 0, len(stream))}
+	v := request{Header: md, Stream: make([]json.RawMessage, 0, len(stream)), HTTP: httpReq}
 	for _, msg := range stream {
 		b, err := mo.Marshal(msg)
 		if err != nil {
@@ -184,6 +245,7 @@ func parseOutputJSON(output string, desc protoreflect.MethodDescriptor, reg *reg
 	result := &methodResult{
 		header:  v.Header,
 		trailer: v.Trailer,
+		http:    v.HTTP,
 	}
 
 	uo := protojson.UnmarshalOptions{Resolver: reg}
@@ -204,13 +266,13 @@ func parseOutputJSON(output string, desc protoreflect.MethodDescriptor, reg *reg
 	switch {
 	case !desc.IsStreamingServer() && len(v.Stream) > 0:
 		return nil, errors.New("unary server method returned a stream")
-	case !desc.IsStreamingServer() && v.Response == nil:
+	case !desc.IsStreamingServer() && v.Response == nil && (v.HTTP == nil || v.HTTP.Body == nil):
 		return nil, errors.New("unary server method did not return a response")
 	case desc.IsStreamingServer() && v.Response != nil:
 		return nil, errors.New("server streaming method returned singular response")
 	}
 
-	if !desc.IsStreamingServer() {
+	if !desc.IsStreamingServer() && v.Response != nil {
 		// Put the singular response into the (empty) stream to return a slice of one element.
 		v.Stream = append(v.Stream, v.Response)
 	}
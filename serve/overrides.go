@@ -0,0 +1,142 @@
+package serve
+
+import (
+	"bytes"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionHeader is the request metadata key that scopes a call to a test
+// session. Overrides set for a session are only seen by calls carrying that
+// session's ID, on top of the overrides that are not scoped to any session.
+const SessionHeader = "x-jig-session"
+
+// overrideExt is the file extension of override method definitions, matching
+// the files read by JsonnetEvaluator.
+const overrideExt = ".jsonnet"
+
+// Overrides holds method definitions set at runtime. They are layered on top
+// of the method directories so they can change a method's behaviour without
+// touching the filesystem. Overrides set with an empty session ID apply to
+// all calls. Overrides is safe for concurrent use.
+type Overrides struct {
+	mu       sync.RWMutex
+	sessions map[string]map[string][]byte // session -> method -> source
+}
+
+// Set overrides the definition of the fully qualified method with source,
+// for the given session.
+func (o *Overrides) Set(session, method, source string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sessions == nil {
+		o.sessions = map[string]map[string][]byte{}
+	}
+	if o.sessions[session] == nil {
+		o.sessions[session] = map[string][]byte{}
+	}
+	o.sessions[session][method] = []byte(source)
+}
+
+// Get returns the overriding source of a method for the given session and
+// whether there is one.
+func (o *Overrides) Get(session, method string) (string, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	b, ok := o.sessions[session][method]
+	return string(b), ok
+}
+
+// Delete removes the override of a method for the given session, returning
+// whether there was one.
+func (o *Overrides) Delete(session, method string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.sessions[session][method]; !ok {
+		return false
+	}
+	delete(o.sessions[session], method)
+	if len(o.sessions[session]) == 0 {
+		delete(o.sessions, session)
+	}
+	return true
+}
+
+// List returns the sorted names of the methods overridden for the given
+// session.
+func (o *Overrides) List(session string) []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	methods := make([]string, 0, len(o.sessions[session]))
+	for method := range o.sessions[session] {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Reset removes all overrides for the given session.
+func (o *Overrides) Reset(session string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.sessions, session)
+}
+
+// ResetAll removes all overrides of all sessions, so all methods use their
+// definitions from the method directories again.
+func (o *Overrides) ResetAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sessions = nil
+}
+
+// FS returns an fs.FS of the override method definitions for a session. It
+// reflects changes made after it is returned.
+func (o *Overrides) FS(session string) fs.FS {
+	return overrideFS{overrides: o, session: session}
+}
+
+type overrideFS struct {
+	overrides *Overrides
+	session   string
+}
+
+// Open opens the override definition of a method, named as
+// <pkg>.<service>.<method>.jsonnet.
+func (o overrideFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	method, ok := strings.CutSuffix(name, overrideExt)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	o.overrides.mu.RLock()
+	b, ok := o.overrides.sessions[o.session][method]
+	o.overrides.mu.RUnlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	// b is never modified in place, only replaced, so it is safe to read
+	// without holding the lock.
+	return &memFile{Reader: bytes.NewReader(b), name: name, size: int64(len(b))}, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return f.size }
+func (f *memFile) Mode() fs.FileMode  { return 0o444 }
+func (f *memFile) ModTime() time.Time { return time.Time{} }
+func (f *memFile) IsDir() bool        { return false }
+func (f *memFile) Sys() interface{}   { return nil }
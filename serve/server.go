@@ -3,12 +3,13 @@
 package serve
 
 import (
-	"fmt"
+	"encoding/json"
 	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"foxygo.at/jig/log"
 	"foxygo.at/jig/reflection"
@@ -59,25 +60,68 @@ func WithLogger(logger log.Logger) Option {
 	}
 }
 
+// WithAdminAPI is an Option to serve the admin API under AdminPathPrefix
+// over HTTP, for managing runtime method overrides and the call journal.
+func WithAdminAPI() Option {
+	return func(s *Server) error {
+		s.admin = s.newAdminHandler()
+		return nil
+	}
+}
+
+// WithJournalSize is an Option to set the number of calls kept in the
+// server's Journal. A size of zero or less disables the journal.
+func WithJournalSize(size int) Option {
+	return func(s *Server) error {
+		s.Journal.size = size
+		return nil
+	}
+}
+
+// WithHTTPHandler is an Option to serve non-grpc traffic with the handler
+// returned by newHandler. newHandler is called once the server's protosets
+// are loaded, so it can use the server's Files and UnknownHandler, e.g. to
+// create an httprule.Handler. It is an alternative to SetHTTPHandler for
+// servers that are started by their constructor.
+func WithHTTPHandler(newHandler func(s *Server) (http.Handler, error)) Option {
+	return func(s *Server) error {
+		s.newHTTP = newHandler
+		return nil
+	}
+}
+
 type Server struct {
 	Files *registry.Files
+	// Overrides holds method definitions set at runtime, taking precedence
+	// over the method definitions in the server's filesystem.
+	Overrides *Overrides
+	// Journal records the calls handled by the server.
+	Journal *Journal
 
-	log  log.Logger
-	gs   *grpc.Server
-	http http.Handler
-	fs   fs.FS
-	fds  []*descriptorpb.FileDescriptorSet // []string
-	eval Evaluator
+	log     log.Logger
+	gs      *grpc.Server
+	http    http.Handler
+	newHTTP func(s *Server) (http.Handler, error) // creates http once protosets are loaded
+	admin   http.Handler
+	grpcWeb *grpcWeb // serves gRPC-Web if not nil
+	connect bool     // serves the Connect protocol
+	fs      fs.FS
+	fds     []*descriptorpb.FileDescriptorSet // []string
+	eval    Evaluator
+	// handlers are Go method implementations, overriding the evaluator.
+	handlers map[protoreflect.FullName]grpc.StreamHandler
 }
 
 // NewServer creates a new Server for given evaluator, e.g. Jsonnet and
 // data Directories.
 func NewServer(eval Evaluator, vfs fs.FS, options ...Option) (*Server, error) {
 	s := &Server{
-		Files: new(registry.Files),
-		log:   log.NewLogger(os.Stderr, log.LogLevelError),
-		eval:  eval,
-		fs:    vfs,
+		Files:     new(registry.Files),
+		Overrides: &Overrides{},
+		Journal:   &Journal{size: DefaultJournalSize},
+		log:       log.NewLogger(os.Stderr, log.LogLevelError),
+		eval:      eval,
+		fs:        vfs,
 	}
 	for _, opt := range options {
 		if err := opt(s); err != nil {
@@ -87,6 +131,16 @@ func NewServer(eval Evaluator, vfs fs.FS, options ...Option) (*Server, error) {
 	if err := s.loadProtosets(); err != nil {
 		return nil, err
 	}
+	if err := s.checkMethodHandlers(); err != nil {
+		return nil, err
+	}
+	if s.newHTTP != nil {
+		h, err := s.newHTTP(s)
+		if err != nil {
+			return nil, err
+		}
+		s.http = h
+	}
 	return s, nil
 }
 
@@ -97,20 +151,48 @@ func (s *Server) SetHTTPHandler(handler http.Handler) {
 }
 
 func (s *Server) Serve(lis net.Listener) error {
-	s.gs = grpc.NewServer(grpc.UnknownServiceHandler(s.UnknownHandler))
+	s.gs = grpc.NewServer(grpc.UnknownServiceHandler(s.UnknownHandler), grpc.ForceServerCodec(serverCodec{}))
 	reflection.NewService(s.Files).Register(s.gs)
-	if s.http != nil {
+	if s.http != nil || s.admin != nil || s.grpcWeb != nil || s.connect {
 		return http.Serve(lis, h2c.NewHandler(s, &http2.Server{}))
 	}
 	return s.gs.Serve(lis)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.grpcWeb != nil && isGRPCWebRequest(r) {
+		s.serveGRPCWeb(w, r)
+		return
+	}
+	if s.grpcWeb != nil && s.grpcWeb.cors && s.isGRPCWebPreflight(r) {
+		s.grpcWeb.servePreflight(w, r)
+		return
+	}
+	if s.connect {
+		if md := s.connectMethod(r, false); md != nil {
+			s.serveConnect(w, r, md)
+			return
+		}
+	}
 	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
 		s.gs.ServeHTTP(w, r)
 		return
 	}
-	s.http.ServeHTTP(w, r)
+	if s.admin != nil && strings.HasPrefix(r.URL.Path, AdminPathPrefix) {
+		s.admin.ServeHTTP(w, r)
+		return
+	}
+	if s.http != nil {
+		s.http.ServeHTTP(w, r)
+		return
+	}
+	if s.connect {
+		if md := s.connectMethod(r, true); md != nil {
+			s.serveConnect(w, r, md)
+			return
+		}
+	}
+	http.NotFound(w, r)
 }
 
 func (s *Server) ListenAndServe(listenAddr string) error {
@@ -208,7 +290,7 @@ func (s *Server) lookupMethod(name protoreflect.FullName) protoreflect.MethodDes
 // grpc.ServerTransportStreamFromContext(), on which the `Method()` method will
 // be called to find the method name. This should return the method as a HTTP
 // path (/pkg.service/method), as is done by grpc.Server.
-func (s *Server) UnknownHandler(srv interface{}, ss grpc.ServerStream) error {
+func (s *Server) UnknownHandler(srv interface{}, ss grpc.ServerStream) (err error) {
 	var fullMethod protoreflect.FullName
 	var ok bool
 	if fullMethod, ok = srv.(protoreflect.FullName); !ok {
@@ -221,6 +303,13 @@ func (s *Server) UnknownHandler(srv interface{}, ss grpc.ServerStream) error {
 	}
 
 	s.log.Debugf("%s: new request", fullMethod)
+	if isJSONCall(ss.Context()) {
+		ss = &jsonStream{ServerStream: ss, reg: s.Files}
+	}
+	js := &journalStream{ServerStream: ss, reg: s.Files, requests: []json.RawMessage{}}
+	defer func(start time.Time) {
+		s.Journal.record(js.call(string(fullMethod), start, err))
+	}(time.Now())
 
 	md := s.lookupMethod(fullMethod)
 	if md == nil {
@@ -228,47 +317,15 @@ func (s *Server) UnknownHandler(srv interface{}, ss grpc.ServerStream) error {
 		return status.Errorf(codes.Unimplemented, "method not found: %s", fullMethod)
 	}
 
-	if err := s.callMethod(md, ss); err != nil {
+	if handler, ok := s.handlers[fullMethod]; ok {
+		err = handler(fullMethod, js)
+	} else {
+		err = s.callMethod(md, js)
+	}
+	if err != nil {
 		s.log.Errorf("%s: %s", fullMethod, err)
 		return err
 	}
 
 	return nil
 }
-
-type TestServer struct {
-	Server
-	lis net.Listener
-}
-
-// NewTestServer starts and returns a new TestServer.
-// The caller should call Stop when finished, to shut it down.
-func NewTestServer(eval Evaluator, vfs fs.FS, options ...Option) *TestServer {
-	ts := NewUnstartedTestServer(eval, vfs, options...)
-	ts.Start()
-	return ts
-}
-
-// NewTestServer starts and returns a new TestServer.
-// The caller should call Stop when finished, to shut it down.
-func NewUnstartedTestServer(eval Evaluator, vfs fs.FS, options ...Option) *TestServer {
-	s, err := NewServer(eval, vfs, options...)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create TestServer: %v", err))
-	}
-	ts := &TestServer{Server: *s}
-	l, err := net.Listen("tcp", "localhost:0")
-	if err != nil {
-		panic(fmt.Sprintf("TestServer failed to listen: %v", err))
-	}
-	ts.lis = l
-	return ts
-}
-
-func (ts *TestServer) Start() {
-	go ts.Serve(ts.lis) //nolint: errcheck
-}
-
-func (ts *TestServer) Addr() string {
-	return ts.lis.Addr().String()
-}
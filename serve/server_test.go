@@ -222,6 +222,64 @@ func TestGreeterBidiMultiResponseStatusErr(t *testing.T) {
 	require.Equal(t, []string{"application/grpc"}, header.Get("content-type"))
 }
 
+func TestGreeterScenario(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Stop()
+	c := newGreeterClient(t, ts.Addr())
+	defer c.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), ScenarioHeader, "polite")
+	req := &greet.HelloRequest{FirstName: "🌏"}
+	resp, err := c.Hello(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "💃 jig [unary]: Good day to you, 🌏", resp.Greeting)
+
+	// Methods not defined in the scenario use the default definition.
+	stream, err := c.HelloServerStream(ctx, req)
+	require.NoError(t, err)
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "💃 jig [server]: Hello 🌏", resp.Greeting)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), ScenarioHeader, "../greet")
+	_, err = c.Hello(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMethodHandler(t *testing.T) {
+	hello := func(_ context.Context, req *greet.HelloRequest) (*greet.HelloResponse, error) {
+		if req.FirstName == "Bart" {
+			return nil, status.Error(codes.PermissionDenied, "👷 go: no")
+		}
+		return &greet.HelloResponse{Greeting: "👷 go: Hello " + req.FirstName}, nil
+	}
+	withHandler := WithMethodHandler("greet.Greeter.Hello", UnaryHandler(hello))
+	ts := NewTestServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithLogger(log.DiscardLogger), withHandler)
+	defer ts.Stop()
+	c := newGreeterClient(t, ts.Addr())
+	defer c.Close()
+
+	resp, err := c.Hello(context.Background(), &greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	require.Equal(t, "👷 go: Hello 🌏", resp.Greeting)
+	_, err = c.Hello(context.Background(), &greet.HelloRequest{FirstName: "Bart"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Other methods still use the evaluator.
+	stream, err := c.HelloServerStream(context.Background(), &greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "💃 jig [server]: Hello 🌏", resp.Greeting)
+
+	calls := ts.Journal.Calls(CallFilter{Method: "greet.Greeter.Hello"})
+	require.Len(t, calls, 2)
+	require.Equal(t, codes.PermissionDenied, calls[1].Code)
+
+	_, err = NewServer(JsonnetEvaluator(), os.DirFS("testdata/greet"), WithMethodHandler("greet.Greeter.Nope", UnaryHandler(hello)))
+	require.Error(t, err)
+}
+
 //go:embed testdata/greet
 var embedFS embed.FS
 
@@ -276,6 +334,32 @@ func TestHTTPHandler(t *testing.T) {
 	require.Equal(t, "bar", string(body))
 }
 
+func TestInMemoryTestServer(t *testing.T) {
+	methods := MethodsFS(map[string]string{
+		"greet.Greeter.Hello": `function(input) { response: { greeting: 'in memory ' + input.request.firstName } }`,
+	})
+	withHTTP := WithHTTPHandler(func(s *Server) (http.Handler, error) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/foo", func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("bar")) //nolint:errcheck
+		})
+		return mux, nil
+	})
+	ts := NewInMemoryTestServer(t, JsonnetEvaluator(), methods, WithLogger(log.DiscardLogger), WithProtosets("testdata/greet/greeter.pb"), withHTTP)
+
+	c := greet.NewGreeterClient(ts.ClientConn)
+	resp, err := c.Hello(context.Background(), &greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	require.Equal(t, "in memory 🌏", resp.Greeting)
+
+	httpResp, err := ts.HTTPClient.Get("http://jig/foo")
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(body))
+}
+
 type greeterClient struct {
 	*grpc.ClientConn
 	greet.GreeterClient
@@ -294,3 +378,30 @@ func newGreeterClient(t *testing.T, addr string) *greeterClient {
 		GreeterClient: gc,
 	}
 }
+
+func TestParseHTTPOutput(t *testing.T) {
+	md := greet.File_greet_greeter_proto.Services().Get(0).Methods().ByName("Hello")
+	output := `{
+		"response": {"greeting": "hi"},
+		"http": {"status": 201, "headers": {"Location": "/x", "X-Multi": ["a", "b"]}, "body": ""}
+	}`
+	result, err := parseOutputJSON(output, md, nil)
+	require.NoError(t, err)
+	require.Equal(t, 201, result.http.Status)
+	require.Equal(t, http.Header{"Location": {"/x"}, "X-Multi": {"a", "b"}}, result.http.Header)
+	require.NotNil(t, result.http.Body)
+	require.Empty(t, *result.http.Body)
+
+	// A raw body replaces the response of unary methods.
+	result, err = parseOutputJSON(`{"http": {"body": "raw"}}`, md, nil)
+	require.NoError(t, err)
+	require.Empty(t, result.stream)
+	require.Equal(t, "raw", *result.http.Body)
+
+	_, err = parseOutputJSON(`{"http": {"status": 201}}`, md, nil)
+	require.Error(t, err)
+	_, err = parseOutputJSON(`{"response": {}, "http": {"status": 42}}`, md, nil)
+	require.Error(t, err)
+	_, err = parseOutputJSON(`{"response": {}, "http": {"headers": {"X": 1}}}`, md, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"testing"
+	"testing/fstest"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestServer is a Server for tests, listening on a local port or in memory.
+// It embeds the *Server it runs, so tests use its fields and methods.
+type TestServer struct {
+	*Server
+	// ClientConn and HTTPClient are connected to the TestServer. They are
+	// only set by NewInMemoryTestServer.
+	ClientConn *grpc.ClientConn
+	HTTPClient *http.Client
+
+	lis net.Listener
+}
+
+// NewTestServer starts and returns a new TestServer.
+// The caller should call Stop when finished, to shut it down.
+func NewTestServer(eval Evaluator, vfs fs.FS, options ...Option) *TestServer {
+	ts := NewUnstartedTestServer(eval, vfs, options...)
+	ts.Start()
+	return ts
+}
+
+// NewTestServer starts and returns a new TestServer.
+// The caller should call Stop when finished, to shut it down.
+func NewUnstartedTestServer(eval Evaluator, vfs fs.FS, options ...Option) *TestServer {
+	s, err := NewServer(eval, vfs, options...)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create TestServer: %v", err))
+	}
+	ts := &TestServer{Server: s}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(fmt.Sprintf("TestServer failed to listen: %v", err))
+	}
+	ts.lis = l
+	return ts
+}
+
+func (ts *TestServer) Start() {
+	go ts.Serve(ts.lis) //nolint: errcheck
+}
+
+func (ts *TestServer) Addr() string {
+	return ts.lis.Addr().String()
+}
+
+// NewInMemoryTestServer starts and returns a new TestServer listening on an
+// in-memory connection rather than a network port. Its ClientConn and
+// HTTPClient are connected to the server. Any URL host can be used with the
+// HTTPClient. The TestServer is stopped and the clients are closed when the
+// test finishes. Errors fail the test.
+//
+// Use WithHTTPHandler to serve HTTP, and MethodsFS or fstest.MapFS to pass
+// method definitions without files.
+func NewInMemoryTestServer(tb testing.TB, eval Evaluator, vfs fs.FS, options ...Option) *TestServer {
+	tb.Helper()
+	s, err := NewServer(eval, vfs, options...)
+	if err != nil {
+		tb.Fatalf("failed to create TestServer: %v", err)
+		return nil
+	}
+	lis := bufconn.Listen(1024 * 1024)
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		tb.Fatalf("TestServer failed to create client: %v", err)
+		return nil
+	}
+	ts := &TestServer{
+		Server:     s,
+		ClientConn: cc,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dial(ctx, "")
+				},
+			},
+		},
+		lis: lis,
+	}
+	ts.Start()
+	tb.Cleanup(func() {
+		cc.Close() //nolint:errcheck
+		ts.HTTPClient.CloseIdleConnections()
+		ts.Stop()
+		lis.Close() //nolint:errcheck
+	})
+	return ts
+}
+
+// MethodsFS returns an fs.FS containing jsonnet method definitions, from a
+// map of fully qualified method names (pkg.service.method) to jsonnet
+// source.
+func MethodsFS(methods map[string]string) fs.FS {
+	mfs := fstest.MapFS{}
+	for method, source := range methods {
+		mfs[method+".jsonnet"] = &fstest.MapFile{Data: []byte(source)}
+	}
+	return mfs
+}
@@ -0,0 +1,96 @@
+package twirp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Twirp error codes that have no gRPC equivalent.
+const (
+	// Malformed is the code of requests that cannot be decoded.
+	Malformed = "malformed"
+	// BadRoute is the code of requests that do not match a method.
+	BadRoute = "bad_route"
+)
+
+// grpcCodes maps gRPC status codes to Twirp error codes.
+var grpcCodes = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "dataloss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// twirpCodes maps Twirp error codes to HTTP status codes.
+var twirpCodes = map[string]int{
+	"canceled":            http.StatusRequestTimeout,
+	"unknown":             http.StatusInternalServerError,
+	"invalid_argument":    http.StatusBadRequest,
+	Malformed:             http.StatusBadRequest,
+	"deadline_exceeded":   http.StatusRequestTimeout,
+	"not_found":           http.StatusNotFound,
+	BadRoute:              http.StatusNotFound,
+	"already_exists":      http.StatusConflict,
+	"permission_denied":   http.StatusForbidden,
+	"unauthenticated":     http.StatusUnauthorized,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"failed_precondition": http.StatusPreconditionFailed,
+	"aborted":             http.StatusConflict,
+	"out_of_range":        http.StatusBadRequest,
+	"unimplemented":       http.StatusNotImplemented,
+	"internal":            http.StatusInternalServerError,
+	"unavailable":         http.StatusServiceUnavailable,
+	"dataloss":            http.StatusInternalServerError,
+}
+
+// twirpError is the JSON representation of a Twirp error.
+type twirpError struct {
+	Code string            `json:"code"`
+	Msg  string            `json:"msg"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+func (e *twirpError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// GRPCStatus returns the gRPC status of Twirp errors returned to methods,
+// so they are logged and journaled like gRPC errors.
+func (e *twirpError) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, e.Msg)
+}
+
+func badRoute(format string, args ...any) *twirpError {
+	return &twirpError{Code: BadRoute, Msg: fmt.Sprintf(format, args...)}
+}
+
+// newTwirpError converts err to a Twirp error. The code of gRPC status
+// errors is mapped to the corresponding Twirp error code.
+func newTwirpError(err error) *twirpError {
+	var te *twirpError
+	if errors.As(err, &te) {
+		return te
+	}
+	st := status.Convert(err)
+	code, ok := grpcCodes[st.Code()]
+	if !ok {
+		code = "unknown"
+	}
+	return &twirpError{Code: code, Msg: st.Message()}
+}
@@ -0,0 +1,287 @@
+// Package twirp serves protobuf methods over the Twirp protocol: POST
+// requests to /twirp/pkg.service/method with a JSON or binary protobuf body.
+//
+// See https://twitchtv.github.io/twirp/docs/spec_v7.html.
+package twirp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/serve"
+	"foxygo.at/protog/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// DefaultPrefix is the default path prefix of Twirp routes.
+	DefaultPrefix = "/twirp"
+
+	// ContentTypeJSON and ContentTypeProtobuf are the content types of
+	// Twirp requests and responses.
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// Handler serves the unary protobuf methods of a registry over the Twirp
+// protocol. Twirp does not support streaming methods.
+type Handler struct {
+	files          *registry.Files
+	grpcHandler    grpc.StreamHandler
+	log            log.Logger
+	prefix         string
+	defaultHandler http.Handler
+}
+
+// NewHandler returns a new [Handler] that implements [http.Handler] that
+// dispatches Twirp requests for the methods in the given registry to the
+// given gRPC handler. The srv argument passed to the gRPC handler is the
+// [protoreflect.FullName] of the method, as expected by
+// serve.Server.UnknownHandler.
+func NewHandler(files *registry.Files, handler grpc.StreamHandler, options ...Option) (*Handler, error) {
+	h := &Handler{
+		files:       files,
+		grpcHandler: handler,
+		prefix:      DefaultPrefix,
+	}
+	for _, opt := range options {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+	if h.log == nil {
+		h.log = log.NewLogger(os.Stderr, log.LogLevelError)
+	}
+	return h, nil
+}
+
+// Option is a function option for use with [NewHandler].
+type Option func(h *Handler) error
+
+// WithLogger is an [Option] to configure a [Handler] with the given logger.
+func WithLogger(l log.Logger) Option {
+	return func(h *Handler) error {
+		h.log = l
+		return nil
+	}
+}
+
+// WithPrefix is an [Option] to configure the path prefix of the Twirp
+// routes of a [Handler], [DefaultPrefix] by default. An empty prefix serves
+// methods at /pkg.service/method.
+func WithPrefix(prefix string) Option {
+	return func(h *Handler) error {
+		h.prefix = strings.TrimSuffix(prefix, "/")
+		return nil
+	}
+}
+
+// WithDefaultHandler is an [Option] to configure a [Handler] with a fallback
+// handler for requests outside the path prefix of its Twirp routes, e.g. an
+// httprule.Handler. By default the [Handler] returns a 404 NotFound
+// response for them.
+func WithDefaultHandler(next http.Handler) Option {
+	return func(h *Handler) error {
+		h.defaultHandler = next
+		return nil
+	}
+}
+
+// ServeHTTP implements [http.Handler].
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := strings.CutPrefix(r.URL.Path, h.prefix+"/")
+	if !ok {
+		if h.defaultHandler != nil {
+			h.defaultHandler.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, badRoute("unsupported method %s (only POST is allowed)", r.Method))
+		return
+	}
+	md := h.lookupMethod(route)
+	if md == nil {
+		writeError(w, badRoute("no handler for path %q", r.URL.Path))
+		return
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		writeError(w, badRoute("streaming method %s is not supported", md.FullName()))
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != ContentTypeJSON && mediaType != ContentTypeProtobuf {
+		writeError(w, badRoute("unexpected Content-Type: %q", r.Header.Get("Content-Type")))
+		return
+	}
+
+	ss := &serverStream{
+		ctx:  metadata.NewIncomingContext(r.Context(), serve.IncomingMetadata(r.Header, metadataKey)),
+		req:  r,
+		json: mediaType == ContentTypeJSON,
+		reg:  h.files,
+	}
+	if err := h.grpcHandler(md.FullName(), ss); err != nil {
+		h.log.Debugf("%s: %v", md.FullName(), err)
+		ss.writeError(w, err)
+		return
+	}
+	ss.writeResp(w)
+}
+
+// lookupMethod returns the method of a Twirp route, pkg.service/method, or
+// nil if there is no such method.
+func (h *Handler) lookupMethod(route string) protoreflect.MethodDescriptor {
+	service, method, ok := strings.Cut(route, "/")
+	if !ok || strings.Contains(method, "/") {
+		return nil
+	}
+	desc, err := h.files.FindDescriptorByName(protoreflect.FullName(service + "." + method))
+	if err != nil {
+		return nil
+	}
+	md, _ := desc.(protoreflect.MethodDescriptor)
+	return md
+}
+
+// metadataKey returns the metadata key of a request header of a Twirp
+// call, which is any header but those of the transport.
+func metadataKey(name string) (string, bool) {
+	key := strings.ToLower(name)
+	if key == "content-type" || key == "content-length" || key == "accept-encoding" || key == "te" {
+		return "", false
+	}
+	return key, true
+}
+
+// serverStream is a grpc.ServerStream of a Twirp call. The response is
+// buffered until the call returns.
+type serverStream struct {
+	ctx  context.Context
+	req  *http.Request
+	json bool
+	reg  *registry.Files
+
+	header   metadata.MD
+	trailer  metadata.MD
+	received bool
+	resp     proto.Message
+}
+
+var _ grpc.ServerStream = &serverStream{}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *serverStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *serverStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	if s.received {
+		return io.EOF
+	}
+	s.received = true
+	b, err := io.ReadAll(io.LimitReader(s.req.Body, serve.MaxMessageSize+1))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot read request: %v", err)
+	}
+	if len(b) > serve.MaxMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "request larger than %d bytes", serve.MaxMessageSize)
+	}
+	if s.json {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true, Resolver: s.reg}.Unmarshal(b, m.(proto.Message))
+	} else {
+		err = proto.Unmarshal(b, m.(proto.Message))
+	}
+	if err != nil {
+		return &twirpError{Code: Malformed, Msg: "the request could not be decoded: " + err.Error()}
+	}
+	return nil
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	if s.resp != nil {
+		return status.Error(codes.Internal, "only one response expected")
+	}
+	s.resp = m.(proto.Message)
+	return nil
+}
+
+// setMetadata adds the header and trailer metadata of the call to the
+// response headers.
+func (s *serverStream) setMetadata(w http.ResponseWriter) {
+	for _, md := range []metadata.MD{s.header, s.trailer} {
+		for key, values := range md {
+			for _, value := range values {
+				if strings.HasSuffix(key, "-bin") {
+					value = base64.RawStdEncoding.EncodeToString([]byte(value))
+				}
+				w.Header().Add(key, value)
+			}
+		}
+	}
+}
+
+func (s *serverStream) writeResp(w http.ResponseWriter) {
+	if s.resp == nil {
+		s.writeError(w, status.Error(codes.Internal, "method returned no response"))
+		return
+	}
+	var b []byte
+	var err error
+	contentType := ContentTypeProtobuf
+	if s.json {
+		contentType = ContentTypeJSON
+		mo := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true, Resolver: s.reg}
+		b, err = mo.Marshal(s.resp)
+	} else {
+		b, err = proto.Marshal(s.resp)
+	}
+	if err != nil {
+		s.writeError(w, status.Errorf(codes.Internal, "cannot encode response: %v", err))
+		return
+	}
+	s.setMetadata(w)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b) //nolint:errcheck
+}
+
+func (s *serverStream) writeError(w http.ResponseWriter, err error) {
+	s.setMetadata(w)
+	writeError(w, err)
+}
+
+// writeError writes err as a Twirp error response.
+func writeError(w http.ResponseWriter, err error) {
+	te := newTwirpError(err)
+	b, _ := json.Marshal(te)
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(twirpCodes[te.Code])
+	w.Write(b) //nolint:errcheck
+}
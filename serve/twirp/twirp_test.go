@@ -0,0 +1,115 @@
+package twirp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"foxygo.at/jig/log"
+	"foxygo.at/jig/pb/greet"
+	"foxygo.at/jig/serve"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestServer(t *testing.T, options ...Option) *serve.TestServer {
+	t.Helper()
+	options = append(options, WithLogger(log.DiscardLogger))
+	withTwirp := serve.WithHTTPHandler(func(s *serve.Server) (http.Handler, error) {
+		return NewHandler(s.Files, s.UnknownHandler, options...)
+	})
+	return serve.NewInMemoryTestServer(t, serve.JsonnetEvaluator(), os.DirFS("../testdata/greet"), serve.WithLogger(log.DiscardLogger), withTwirp)
+}
+
+func post(t *testing.T, ts *serve.TestServer, path, contentType, body string) (*http.Response, string) {
+	t.Helper()
+	resp, err := ts.HTTPClient.Post("http://jig"+path, contentType, strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(b)
+}
+
+func requireTwirpError(t *testing.T, resp *http.Response, body string, wantStatus int, wantCode string) *twirpError {
+	t.Helper()
+	require.Equal(t, wantStatus, resp.StatusCode, body)
+	require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+	te := &twirpError{}
+	require.NoError(t, json.Unmarshal([]byte(body), te))
+	require.Equal(t, wantCode, te.Code)
+	return te
+}
+
+func TestTwirp(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := post(t, ts, "/twirp/greet.Greeter/Hello", ContentTypeJSON, `{"first_name": "🌏", "unknown": 1}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, ContentTypeJSON, resp.Header.Get("Content-Type"))
+	require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello 🌏"}`, body)
+
+	req, err := proto.Marshal(&greet.HelloRequest{FirstName: "🌏"})
+	require.NoError(t, err)
+	resp, body = post(t, ts, "/twirp/greet.Greeter/Hello", ContentTypeProtobuf, string(req))
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, ContentTypeProtobuf, resp.Header.Get("Content-Type"))
+	msg := &greet.HelloResponse{}
+	require.NoError(t, proto.Unmarshal([]byte(body), msg))
+	require.Equal(t, "💃 jig [unary]: Hello 🌏", msg.Greeting)
+}
+
+func TestTwirpErrors(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := post(t, ts, "/twirp/greet.Greeter/Hello", ContentTypeJSON, `{"firstName": "Bart"}`)
+	te := requireTwirpError(t, resp, body, http.StatusBadRequest, "invalid_argument")
+	require.Equal(t, "💃 jig [unary]: eat my shorts", te.Msg)
+	require.Equal(t, []string{"my", "shorts"}, resp.Header.Values("Eat"))
+	require.Equal(t, "cow", resp.Header.Get("A"))
+
+	resp, body = post(t, ts, "/twirp/greet.Greeter/Hello", ContentTypeJSON, `{"firstName": 1}`)
+	requireTwirpError(t, resp, body, http.StatusBadRequest, Malformed)
+
+	tests := map[string]struct {
+		path        string
+		contentType string
+	}{
+		"unknown method":   {path: "/twirp/greet.Greeter/Missing", contentType: ContentTypeJSON},
+		"unknown service":  {path: "/twirp/greet.Missing/Hello", contentType: ContentTypeJSON},
+		"long path":        {path: "/twirp/greet.Greeter/Hello/x", contentType: ContentTypeJSON},
+		"streaming method": {path: "/twirp/greet.Greeter/HelloServerStream", contentType: ContentTypeJSON},
+		"content type":     {path: "/twirp/greet.Greeter/Hello", contentType: "text/plain"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, body := post(t, ts, tc.path, tc.contentType, `{}`)
+			requireTwirpError(t, resp, body, http.StatusNotFound, BadRoute)
+		})
+	}
+
+	httpResp, err := ts.HTTPClient.Get("http://jig/twirp/greet.Greeter/Hello")
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	b, err := io.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	requireTwirpError(t, httpResp, string(b), http.StatusNotFound, BadRoute)
+}
+
+func TestTwirpPrefixAndDefaultHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("next")) //nolint:errcheck
+	})
+	ts := newTestServer(t, WithPrefix("/rpc/"), WithDefaultHandler(next))
+
+	resp, body := post(t, ts, "/rpc/greet.Greeter/Hello", ContentTypeJSON, `{"firstName": "🌏"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.JSONEq(t, `{"greeting": "💃 jig [unary]: Hello 🌏"}`, body)
+
+	resp, body = post(t, ts, "/twirp/greet.Greeter/Hello", ContentTypeJSON, `{"firstName": "🌏"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, "next", body)
+}